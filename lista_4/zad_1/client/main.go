@@ -4,37 +4,111 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // command is the same as defined on the server.
 type command struct {
-	Op    string `json:"op"`
-	Key   string `json:"key"`
-	Value string `json:"value,omitempty"`
+	Op           string  `json:"op"`
+	Key          string  `json:"key"`
+	Value        string  `json:"value,omitempty"`
+	Expected     *string `json:"expected,omitempty"`
+	Ops          []txnOp `json:"ops,omitempty"`
+	TTL          int64   `json:"ttl,omitempty"`
+	Revision     uint64  `json:"revision,omitempty"`
+	Owner        string  `json:"owner,omitempty"`
+	Token        uint64  `json:"token,omitempty"`
+	Delta        int64   `json:"delta,omitempty"`
+	Consistency  string  `json:"consistency,omitempty"`
+	Node         string  `json:"node,omitempty"`
+	MaxStaleness string  `json:"max_staleness,omitempty"`
+	ClientID     string  `json:"client_id,omitempty"`
+	Seq          uint64  `json:"seq,omitempty"`
+}
+
+// serverURL is the server the client talks to. In a multi-process cluster any
+// node will do; requests are redirected to the node that must serve them.
+var serverURL = flag.String("server", "http://localhost:8080", "base URL of the server")
+
+// writeAttempts is how many times a write is sent before giving up. Retries
+// reuse the write's sequence number, so the server applies it at most once.
+const writeAttempts = 3
+
+// Every write carries this client's session ID and the next sequence number.
+var (
+	clientID = newClientID()
+	nextSeq  uint64
+)
+
+func newClientID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("failed to generate client ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// txnOp is a single operation inside a "txn" command.
+type txnOp struct {
+	Op       string  `json:"op"`
+	Key      string  `json:"key"`
+	Value    string  `json:"value,omitempty"`
+	Expected *string `json:"expected,omitempty"`
 }
 
 func executeCommand(cmd command) {
-	data, err := json.Marshal(cmd)
-	if err != nil {
-		log.Printf("Error: %v\n", err)
-		return
+	attempts := 1
+	if cmd.Op != "get" {
+		nextSeq++
+		cmd.ClientID, cmd.Seq = clientID, nextSeq
+		attempts = writeAttempts
 	}
+	post("/command", cmd, attempts)
+}
 
-	resp, err := http.Post("http://localhost:8080/command", "application/json", bytes.NewReader(data))
+// post sends payload as JSON to the server path and prints the response,
+// retrying up to attempts times while the server is unreachable or has no
+// leader.
+func post(path string, payload interface{}, attempts int) {
+	data, err := json.Marshal(payload)
 	if err != nil {
 		log.Printf("Error: %v\n", err)
 		return
 	}
-	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
+	var body []byte
+	for attempt := 1; ; attempt++ {
+		resp, err := http.Post(*serverURL+path, "application/json", bytes.NewReader(data))
+		if err == nil {
+			body, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				break
+			}
+		}
+		if attempt == attempts {
+			if err != nil {
+				log.Printf("Error: %v\n", err)
+				return
+			}
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
 
 	if !strings.HasSuffix(string(body), "\n") {
 		fmt.Print(string(body) + "\n")
@@ -44,13 +118,32 @@ func executeCommand(cmd command) {
 }
 
 func main() {
+	flag.Parse()
 	fmt.Println("Welcome to the Key-Value Store Client")
 	fmt.Println("Available commands:")
-	fmt.Println("  get <key>")
+	fmt.Println("  get <key> [revision] [linearizable|leader-lease|stale] [node=<node_id>] [max=<staleness>]")
 	fmt.Println("  set <key> <value>")
+	fmt.Println("  setex <key> <ttl_seconds> <value>")
+	fmt.Println("  del <key>")
+	fmt.Println("  incr <key> [n]")
+	fmt.Println("  decr <key> [n]")
+	fmt.Println("  cas <key> <expected|-> <value>  ('-' means the key must not exist)")
+	fmt.Println("  mget <key> [key...]")
+	fmt.Println("  mset <key> <value> [<key> <value>...]")
+	fmt.Println("  scan [prefix]")
+	fmt.Println("  compact <revision>")
+	fmt.Println("  watch <key|prefix*> [from_index]  (Ctrl+C stops watching)")
+	fmt.Println("  lock <name> <owner> <ttl_seconds>")
+	fmt.Println("  renew <name> <owner> <token> <ttl_seconds>")
+	fmt.Println("  unlock <name> <owner> <token>")
+	fmt.Println("  txn  (then check/get/set/del lines, finished by 'commit' or 'abort')")
 	fmt.Println("  leader")
 	fmt.Println("  stop <node_id>")
 	fmt.Println("  start <node_id>") // Add this line
+	fmt.Println("  member list")
+	fmt.Println("  member add <node_id> [raft_address]  (joins as a learner)")
+	fmt.Println("  member promote|demote|remove <node_id>")
+	fmt.Println("  transfer [node_id]  (hands leadership to node_id, or to the most up-to-date voter)")
 	fmt.Println("  quit or exit")
 
 	scanner := bufio.NewScanner(os.Stdin)
@@ -78,11 +171,45 @@ func main() {
 
 		switch cmd.Op {
 		case "get":
-			if len(parts) != 2 {
-				fmt.Println("Usage: get <key>")
+			const usage = "Usage: get <key> [revision] [linearizable|leader-lease|stale] [node=<node_id>] [max=<staleness>]"
+			if len(parts) < 2 {
+				fmt.Println(usage)
 				continue
 			}
 			cmd.Key = parts[1]
+			valid := true
+			for _, arg := range parts[2:] {
+				revision, err := strconv.ParseUint(arg, 10, 64)
+				switch {
+				case err == nil && revision > 0:
+					cmd.Revision = revision
+				case arg == "linearizable" || arg == "leader-lease" || arg == "stale":
+					cmd.Consistency = arg
+				case strings.HasPrefix(arg, "node="):
+					cmd.Consistency = "stale"
+					cmd.Node = strings.TrimPrefix(arg, "node=")
+				case strings.HasPrefix(arg, "max="):
+					cmd.Consistency = "stale"
+					cmd.MaxStaleness = strings.TrimPrefix(arg, "max=")
+				default:
+					valid = false
+				}
+			}
+			if !valid {
+				fmt.Println(usage)
+				continue
+			}
+		case "compact":
+			if len(parts) != 2 {
+				fmt.Println("Usage: compact <revision>")
+				continue
+			}
+			revision, err := strconv.ParseUint(parts[1], 10, 64)
+			if err != nil || revision == 0 {
+				fmt.Println("Revision must be a positive log index")
+				continue
+			}
+			cmd.Revision = revision
 		case "set":
 			if len(parts) < 3 {
 				fmt.Println("Usage: set <key> <value>")
@@ -90,6 +217,137 @@ func main() {
 			}
 			cmd.Key = parts[1]
 			cmd.Value = strings.Join(parts[2:], " ")
+		case "del":
+			if len(parts) != 2 {
+				fmt.Println("Usage: del <key>")
+				continue
+			}
+			cmd.Op = "delete"
+			cmd.Key = parts[1]
+		case "setex":
+			if len(parts) < 4 {
+				fmt.Println("Usage: setex <key> <ttl_seconds> <value>")
+				continue
+			}
+			ttl, err := strconv.ParseInt(parts[2], 10, 64)
+			if err != nil || ttl <= 0 {
+				fmt.Println("TTL must be a positive number of seconds")
+				continue
+			}
+			cmd.Op = "set"
+			cmd.Key = parts[1]
+			cmd.TTL = ttl
+			cmd.Value = strings.Join(parts[3:], " ")
+		case "incr", "decr":
+			if len(parts) < 2 || len(parts) > 3 {
+				fmt.Printf("Usage: %s <key> [n]\n", cmd.Op)
+				continue
+			}
+			cmd.Key = parts[1]
+			if len(parts) == 3 {
+				delta, err := strconv.ParseInt(parts[2], 10, 64)
+				if err != nil || delta <= 0 {
+					fmt.Println("n must be a positive integer")
+					continue
+				}
+				cmd.Delta = delta
+			}
+		case "cas":
+			if len(parts) < 4 {
+				fmt.Println("Usage: cas <key> <expected|-> <value>")
+				continue
+			}
+			cmd.Key = parts[1]
+			if parts[2] != "-" {
+				expected := parts[2]
+				cmd.Expected = &expected
+			}
+			cmd.Value = strings.Join(parts[3:], " ")
+		case "mget":
+			if len(parts) < 2 {
+				fmt.Println("Usage: mget <key> [key...]")
+				continue
+			}
+			post("/mget", map[string][]string{"keys": parts[1:]}, 1)
+			continue
+		case "mset":
+			if len(parts) < 3 || len(parts)%2 != 1 {
+				fmt.Println("Usage: mset <key> <value> [<key> <value>...]")
+				continue
+			}
+			multiSet(parts[1:])
+			continue
+		case "scan":
+			if len(parts) > 2 {
+				fmt.Println("Usage: scan [prefix]")
+				continue
+			}
+			prefix := ""
+			if len(parts) == 2 {
+				prefix = parts[1]
+			}
+			scanKeys(prefix)
+			continue
+		case "watch":
+			if len(parts) < 2 || len(parts) > 3 {
+				fmt.Println("Usage: watch <key|prefix*> [from_index]")
+				continue
+			}
+			from := ""
+			if len(parts) == 3 {
+				if _, err := strconv.ParseUint(parts[2], 10, 64); err != nil {
+					fmt.Println("Index must be a log index")
+					continue
+				}
+				from = parts[2]
+			}
+			watchKey(parts[1], from)
+			continue
+		case "lock":
+			if len(parts) != 4 {
+				fmt.Println("Usage: lock <name> <owner> <ttl_seconds>")
+				continue
+			}
+			ttl, err := strconv.ParseInt(parts[3], 10, 64)
+			if err != nil || ttl <= 0 {
+				fmt.Println("TTL must be a positive number of seconds")
+				continue
+			}
+			cmd.Key, cmd.Owner, cmd.TTL = parts[1], parts[2], ttl
+		case "renew":
+			if len(parts) != 5 {
+				fmt.Println("Usage: renew <name> <owner> <token> <ttl_seconds>")
+				continue
+			}
+			token, err := strconv.ParseUint(parts[3], 10, 64)
+			if err != nil {
+				fmt.Println("Token must be a number")
+				continue
+			}
+			ttl, err := strconv.ParseInt(parts[4], 10, 64)
+			if err != nil || ttl <= 0 {
+				fmt.Println("TTL must be a positive number of seconds")
+				continue
+			}
+			cmd.Key, cmd.Owner, cmd.Token, cmd.TTL = parts[1], parts[2], token, ttl
+		case "unlock":
+			if len(parts) != 4 {
+				fmt.Println("Usage: unlock <name> <owner> <token>")
+				continue
+			}
+			token, err := strconv.ParseUint(parts[3], 10, 64)
+			if err != nil {
+				fmt.Println("Token must be a number")
+				continue
+			}
+			cmd.Key, cmd.Owner, cmd.Token = parts[1], parts[2], token
+		case "txn":
+			ops, ok := readTxn(scanner)
+			if !ok {
+				fmt.Println("Transaction aborted")
+				continue
+			}
+			cmd.Ops = ops
 		case "leader":
 			checkLeader()
 			continue
@@ -107,8 +365,22 @@ func main() {
 			}
 			startNode(parts[1])
 			continue
+		case "member":
+			memberCommand(parts[1:])
+			continue
+		case "transfer":
+			if len(parts) > 2 {
+				fmt.Println("Usage: transfer [node_id]")
+				continue
+			}
+			req := map[string]string{}
+			if len(parts) == 2 {
+				req["node_id"] = parts[1]
+			}
+			post("/transfer-leadership", req, 1) // a retry could move leadership twice
+			continue
 		default:
-			fmt.Println("Unknown command. Use 'get', 'set', 'leader', 'stop', 'start', or 'quit'/'exit'")
+			fmt.Println("Unknown command. Use 'get', 'set', 'setex', 'del', 'incr', 'decr', 'cas', 'mget', 'mset', 'scan', 'compact', 'watch', 'lock', 'renew', 'unlock', 'txn', 'leader', 'stop', 'start', 'member', 'transfer', or 'quit'/'exit'")
 			continue
 		}
 
@@ -120,22 +392,276 @@ func main() {
 	}
 }
 
+// readTxn collects transaction operations line by line until "commit" (ok is
+// true) or "abort"/end of input (ok is false).
+func readTxn(scanner *bufio.Scanner) (ops []txnOp, ok bool) {
+	for {
+		fmt.Print("txn> ")
+		if !scanner.Scan() {
+			return nil, false
+		}
+		parts := strings.Fields(scanner.Text())
+		if len(parts) == 0 {
+			continue
+		}
+
+		switch strings.ToLower(parts[0]) {
+		case "commit":
+			if len(ops) == 0 {
+				fmt.Println("Transaction is empty")
+				continue
+			}
+			return ops, true
+		case "abort":
+			return nil, false
+		case "check":
+			if len(parts) != 3 {
+				fmt.Println("Usage: check <key> <expected|->")
+				continue
+			}
+			op := txnOp{Op: "check", Key: parts[1]}
+			if parts[2] != "-" {
+				expected := parts[2]
+				op.Expected = &expected
+			}
+			ops = append(ops, op)
+		case "get":
+			if len(parts) != 2 {
+				fmt.Println("Usage: get <key>")
+				continue
+			}
+			ops = append(ops, txnOp{Op: "get", Key: parts[1]})
+		case "set":
+			if len(parts) < 3 {
+				fmt.Println("Usage: set <key> <value>")
+				continue
+			}
+			ops = append(ops, txnOp{Op: "set", Key: parts[1], Value: strings.Join(parts[2:], " ")})
+		case "del":
+			if len(parts) != 2 {
+				fmt.Println("Usage: del <key>")
+				continue
+			}
+			ops = append(ops, txnOp{Op: "delete", Key: parts[1]})
+		default:
+			fmt.Println("Unknown transaction command. Use 'check', 'get', 'set', 'del', 'commit' or 'abort'")
+		}
+	}
+}
+
+// multiSet writes alternating keys and values in a single request.
+func multiSet(pairs []string) {
+	type entry struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	nextSeq++
+	req := struct {
+		Entries  []entry `json:"entries"`
+		ClientID string  `json:"client_id"`
+		Seq      uint64  `json:"seq"`
+	}{ClientID: clientID, Seq: nextSeq}
+	for i := 0; i < len(pairs); i += 2 {
+		req.Entries = append(req.Entries, entry{Key: pairs[i], Value: pairs[i+1]})
+	}
+	post("/mset", req, writeAttempts)
+}
+
+// scanKeys prints every key starting with prefix, following the server's
+// continuation cursor page by page.
+func scanKeys(prefix string) {
+	cursor := ""
+	count := 0
+	for {
+		params := url.Values{"prefix": {prefix}}
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+
+		resp, err := http.Get(*serverURL + "/scan?" + params.Encode())
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			return
+		}
+
+		var page struct {
+			Entries []struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			} `json:"entries"`
+			NextCursor string `json:"next_cursor"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			fmt.Printf("Error: %s\n", strings.TrimSpace(string(body)))
+			return
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			return
+		}
+
+		for _, e := range page.Entries {
+			fmt.Printf("%s = %s\n", e.Key, e.Value)
+		}
+		count += len(page.Entries)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	fmt.Printf("(%d keys)\n", count)
+}
+
+// watchKey streams changes to key (or to every key under a prefix when key
+// ends with '*') until the user presses Ctrl+C or the server ends the stream.
+func watchKey(key, from string) {
+	params := url.Values{}
+	if strings.HasSuffix(key, "*") {
+		params.Set("key", strings.TrimSuffix(key, "*"))
+		params.Set("prefix", "true")
+	} else {
+		params.Set("key", key)
+	}
+	if from != "" {
+		params.Set("from", from)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, *serverURL+"/watch?"+params.Encode(), nil)
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Printf("Error: %s\n", strings.TrimSpace(string(body)))
+		return
+	}
+
+	fmt.Println("Watching, press Ctrl+C to stop")
+	var lastIndex uint64
+	events := bufio.NewScanner(resp.Body)
+	for events.Scan() {
+		var e struct {
+			Type  string `json:"type"`
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Index uint64 `json:"index"`
+		}
+		if err := json.Unmarshal(events.Bytes(), &e); err != nil {
+			log.Printf("Error: %v\n", err)
+			continue
+		}
+		lastIndex = e.Index
+		if e.Type == "delete" {
+			fmt.Printf("[%d] delete %s\n", e.Index, e.Key)
+		} else {
+			fmt.Printf("[%d] %s %s = %s\n", e.Index, e.Type, e.Key, e.Value)
+		}
+	}
+
+	if ctx.Err() != nil {
+		fmt.Println("Stopped watching")
+	} else if lastIndex > 0 {
+		fmt.Printf("Watch ended by server, resume with: watch %s %d\n", key, lastIndex+1)
+	} else {
+		fmt.Println("Watch ended by server")
+	}
+}
+
 // Add this new function
 func checkLeader() {
-	resp, err := http.Get("http://localhost:8080/leader")
+	resp, err := http.Get(*serverURL + "/leader")
 	if err != nil {
 		log.Printf("Error: %v\n", err)
 		return
 	}
 	defer resp.Body.Close()
 
-	var result map[string]string
+	var result struct {
+		Leader string `json:"leader"`
+		State  string `json:"state"`
+	}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		log.Printf("Error: %v\n", err)
 		return
 	}
 
-	fmt.Printf("Current leader: %s (State: %s)\n", result["leader"], result["state"])
+	fmt.Printf("Current leader: %s (State: %s)\n", result.Leader, result.State)
+}
+
+// memberCommand runs "member list|add|remove|promote|demote".
+func memberCommand(args []string) {
+	usage := "Usage: member list | member add <node_id> [raft_address] | member remove|promote|demote <node_id>"
+	if len(args) == 0 {
+		fmt.Println(usage)
+		return
+	}
+	switch action := strings.ToLower(args[0]); {
+	case action == "list" && len(args) == 1:
+		listMembers()
+	case action == "add" && (len(args) == 2 || len(args) == 3):
+		req := map[string]string{"node_id": args[1]}
+		if len(args) == 3 {
+			req["address"] = args[2]
+		}
+		post("/member/add", req, writeAttempts)
+	case (action == "remove" || action == "promote" || action == "demote") && len(args) == 2:
+		post("/member/"+action, map[string]string{"node_id": args[1]}, writeAttempts)
+	default:
+		fmt.Println(usage)
+	}
+}
+
+func listMembers() {
+	resp, err := http.Get(*serverURL + "/members")
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var members []struct {
+		ID       string `json:"id"`
+		Address  string `json:"address"`
+		Suffrage string `json:"suffrage"`
+		Leader   bool   `json:"leader"`
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, &members); err != nil {
+		fmt.Printf("Server response: %s\n", strings.TrimSpace(string(body)))
+		return
+	}
+	for _, m := range members {
+		role := strings.ToLower(m.Suffrage)
+		if m.Leader {
+			role += ", leader"
+		}
+		fmt.Printf("%s\t%s\t(%s)\n", m.ID, m.Address, role)
+	}
 }
 
 // Add this new function
@@ -150,7 +676,7 @@ func stopNode(nodeID string) {
 		return
 	}
 
-	resp, err := http.Post("http://localhost:8080/stop", "application/json", bytes.NewReader(jsonData))
+	resp, err := http.Post(*serverURL+"/stop", "application/json", bytes.NewReader(jsonData))
 	if err != nil {
 		log.Printf("Error: %v\n", err)
 		return
@@ -173,7 +699,7 @@ func stopNode(nodeID string) {
 	if result["error"] != "" {
 		fmt.Printf("Error: %s\n", result["error"])
 	} else {
-		fmt.Printf("Node %s stopped successfully\n", nodeID)
+		fmt.Printf("%s: %s\n", nodeID, result["message"])
 	}
 }
 
@@ -189,7 +715,7 @@ func startNode(nodeID string) {
 		return
 	}
 
-	resp, err := http.Post("http://localhost:8080/start", "application/json", bytes.NewReader(jsonData))
+	resp, err := http.Post(*serverURL+"/start", "application/json", bytes.NewReader(jsonData))
 	if err != nil {
 		log.Printf("Error: %v\n", err)
 		return
@@ -203,16 +729,35 @@ func startNode(nodeID string) {
 	}
 
 	// Try to decode as JSON first
-	var result map[string]string
+	var result struct {
+		Error              string `json:"error"`
+		RestoredIndex      uint64 `json:"restored_index"`
+		ReplayedEntries    uint64 `json:"replayed_entries"`
+		TransferredEntries uint64 `json:"transferred_entries"`
+		SnapshotInstalled  bool   `json:"snapshot_installed"`
+		CaughtUp           bool   `json:"caught_up"`
+	}
 	if err := json.Unmarshal(body, &result); err != nil {
 		// If not JSON, print the raw message
 		fmt.Printf("Server response: %s\n", string(body))
 		return
 	}
 
-	if result["error"] != "" {
-		fmt.Printf("Error: %s\n", result["error"])
+	if result.Error != "" {
+		fmt.Printf("Error: %s\n", result.Error)
+		return
+	}
+	fmt.Printf("Node %s started successfully\n", nodeID)
+	if result.RestoredIndex > 0 {
+		fmt.Printf("  restored from its own snapshot at index %d\n", result.RestoredIndex)
+	}
+	fmt.Printf("  replayed %d entries from its own log\n", result.ReplayedEntries)
+	if result.SnapshotInstalled {
+		fmt.Printf("  received a snapshot from the leader covering %d entries\n", result.TransferredEntries)
 	} else {
-		fmt.Printf("Node %s started successfully\n", nodeID)
+		fmt.Printf("  received %d entries from the leader\n", result.TransferredEntries)
+	}
+	if !result.CaughtUp {
+		fmt.Println("  still catching up with the leader")
 	}
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maxBatchSize bounds the number of keys in a single mget or mset request.
+const maxBatchSize = 1000
+
+// mgetRequest is the body of a multi-get.
+type mgetRequest struct {
+	Keys         []string `json:"keys"`
+	Consistency  string   `json:"consistency,omitempty"`
+	Node         string   `json:"node,omitempty"`
+	MaxStaleness string   `json:"max_staleness,omitempty"`
+}
+
+// mgetEntry is the result for one key of a multi-get.
+type mgetEntry struct {
+	Key      string `json:"key"`
+	Found    bool   `json:"found"`
+	Value    string `json:"value,omitempty"`
+	Revision uint64 `json:"revision,omitempty"` // log index at which the value was written
+}
+
+// mgetResponse is the body returned for a multi-get.
+type mgetResponse struct {
+	Results []mgetEntry `json:"results"`
+	readInfo
+}
+
+// msetRequest is the body of a batch set. Its entries are written in a single
+// log entry.
+type msetRequest struct {
+	Entries []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"entries"`
+	ClientID string `json:"client_id,omitempty"`
+	Seq      uint64 `json:"seq,omitempty"`
+}
+
+// getMany reads keys under a single acquisition of f.mu, so the results form
+// one consistent view of the store.
+func (f *fsm) getMany(keys []string) []mgetEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	results := make([]mgetEntry, len(keys))
+	for i, key := range keys {
+		results[i].Key = key
+		value, ok := f.store.get(key)
+		if !ok {
+			continue
+		}
+		results[i].Found = true
+		results[i].Value = value
+		if h, ok := f.history.get(key); ok && len(h.Versions) > 0 {
+			results[i].Revision = h.Versions[len(h.Versions)-1].Index
+		}
+	}
+	return results
+}
+
+// mgetHandler reads many keys from one node at the requested consistency
+// level.
+func mgetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req mgetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Keys) == 0 || len(req.Keys) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("mget needs between 1 and %d keys", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+	opts, err := parseReadOptions(req.Consistency, req.Node, req.MaxStaleness)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, info, err := reader(opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	json.NewEncoder(w).Encode(mgetResponse{Results: f.getMany(req.Keys), readInfo: info})
+}
+
+// msetHandler writes many keys as one transaction, so they are committed in
+// a single log entry and applied together. The per-key outcomes are returned
+// in the result's results list.
+func msetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req msetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeResult(w, badCommand(codeBadCommand, "%v", err))
+		return
+	}
+	if len(req.Entries) == 0 || len(req.Entries) > maxBatchSize {
+		writeResult(w, badCommand(codeBadCommand, "mset needs between 1 and %d entries", maxBatchSize))
+		return
+	}
+
+	cmd := command{Op: "txn", ClientID: req.ClientID, Seq: req.Seq}
+	for _, e := range req.Entries {
+		cmd.Ops = append(cmd.Ops, txnOp{Op: "set", Key: e.Key, Value: e.Value})
+	}
+	writeResult(w, propose(cmd))
+}
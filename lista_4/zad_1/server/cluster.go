@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// memberByID returns the cluster member with the given ID.
+func memberByID(id string) (clusterMember, bool) {
+	for _, m := range cfg.Nodes {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return clusterMember{}, false
+}
+
+// runNode runs this process as the single node id of a multi-process
+// cluster, talking to its peers over TCP. It only returns on failure.
+func runNode(id string) error {
+	self, ok := memberByID(id)
+	if !ok {
+		return fmt.Errorf("node %q is not a member of the cluster", id)
+	}
+
+	trans, err := raft.NewTCPTransport(self.Raft, nil, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("failed to create TCP transport: %v", err)
+	}
+	r, f, err := createRaftNode(id, trans, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create raft node %s: %v", id, err)
+	}
+
+	// The handlers work on the running nodes of this process, which is just
+	// this one.
+	nodeIDs = []string{id}
+	raftNodes = []*raft.Raft{r}
+	fsms = []*fsm{f}
+	nodeState = []bool{true}
+
+	// Every member bootstraps with the same configuration, which Raft
+	// allows; a node that already has state keeps it, and a node joining a
+	// running cluster waits to be added with "member add".
+	if index := r.LastIndex(); index > 0 {
+		log.Printf("[Node %s] Recovered existing state up to index %d, skipping bootstrap", id, index)
+	} else if *joinFlag {
+		log.Printf("[Node %s] Waiting to be added to the cluster", id)
+	} else {
+		configuration := raft.Configuration{}
+		for _, m := range cfg.Nodes {
+			configuration.Servers = append(configuration.Servers, raft.Server{
+				ID:      raft.ServerID(m.ID),
+				Address: raft.ServerAddress(m.Raft),
+			})
+		}
+		if err := r.BootstrapCluster(configuration).Error(); err != nil && err != raft.ErrCantBootstrap {
+			return fmt.Errorf("failed to bootstrap cluster: %v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/command", routeRequest(commandHandler))
+	mux.HandleFunc("/mget", routeRequest(mgetHandler))
+	mux.HandleFunc("/mset", routeRequest(msetHandler))
+	mux.HandleFunc("/scan", routeRequest(scanHandler))
+	mux.HandleFunc("/watch", routeRequest(watchHandler))
+	mux.HandleFunc("/leader", nodeLeaderHandler)
+	mux.HandleFunc("/members", routeRequest(membersHandler))
+	mux.HandleFunc("/member/add", routeRequest(memberHandler(addMember)))
+	mux.HandleFunc("/member/remove", routeRequest(memberHandler(removeMember)))
+	mux.HandleFunc("/member/promote", routeRequest(memberHandler(promoteMember)))
+	mux.HandleFunc("/member/demote", routeRequest(memberHandler(demoteMember)))
+	mux.HandleFunc("/transfer-leadership", routeRequest(transferLeadershipHandler))
+	log.Printf("[Node %s] Raft on %s, client API listening on %s", id, self.Raft, self.HTTP)
+	return http.ListenAndServe(self.HTTP, mux)
+}
+
+// forwardedHeader marks a request proxied by another node, so that nodes
+// with differing views of the leader do not pass it back and forth.
+const forwardedHeader = "X-Forwarded-By-Node"
+
+// routeRequest serves a request on this node if it is the node that has to
+// answer it and otherwise forwards it there, as chosen by cfg.Forward: stale
+// reads go to the requested node, or stay here if none was named, and
+// everything else goes to the leader, as reported by raft.LeaderWithID. The
+// consistency and node parameters are taken from the query string or,
+// failing that, from the JSON body.
+func routeRequest(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := struct {
+			Consistency string `json:"consistency"`
+			Node        string `json:"node"`
+		}{Consistency: r.URL.Query().Get("consistency"), Node: r.URL.Query().Get("node")}
+		if r.Body != nil && r.Method == http.MethodPost {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.Unmarshal(body, &params) // malformed bodies are reported by h
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		self := raftNodes[0]
+		target := params.Node
+		if params.Consistency != consistencyStale {
+			_, leaderID := self.LeaderWithID()
+			target = string(leaderID)
+			if target == "" {
+				http.Error(w, "no leader elected", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if target == "" || target == nodeIDs[0] {
+			h(w, r)
+			return
+		}
+		m, ok := memberByID(target)
+		if !ok {
+			http.Error(w, fmt.Sprintf("node %q is not a member of the cluster", target), http.StatusNotFound)
+			return
+		}
+		if cfg.Forward == "proxy" {
+			proxyTo(w, r, m)
+			return
+		}
+		// 307 keeps the method and body, so clients resend the request
+		// unchanged.
+		http.Redirect(w, r, "http://"+m.HTTP+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}
+}
+
+// proxyTo passes the request on to member m and copies back its response.
+// Responses are flushed as they arrive, so watches stream through.
+func proxyTo(w http.ResponseWriter, r *http.Request, m clusterMember) {
+	if by := r.Header.Get(forwardedHeader); by != "" {
+		http.Error(w, fmt.Sprintf("node %s forwarded the request to %s, which expects %s to serve it", by, nodeIDs[0], m.ID), http.StatusServiceUnavailable)
+		return
+	}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: m.HTTP})
+	proxy.FlushInterval = -1
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		http.Error(w, fmt.Sprintf("failed to reach node %s: %v", m.ID, err), http.StatusBadGateway)
+	}
+	r.Header.Set(forwardedHeader, nodeIDs[0])
+	proxy.ServeHTTP(w, r)
+}
+
+// nodeStatus is the body returned by /leader in multi-process mode.
+type nodeStatus struct {
+	Leader       string `json:"leader"`
+	Node         string `json:"node"`
+	State        string `json:"state"`
+	AppliedIndex uint64 `json:"applied_index"`
+}
+
+// nodeLeaderHandler reports the leader as known to this node, together with
+// the node's own progress.
+func nodeLeaderHandler(w http.ResponseWriter, r *http.Request) {
+	self := raftNodes[0]
+	_, leaderID := self.LeaderWithID()
+	if leaderID == "" {
+		http.Error(w, "no leader elected", http.StatusServiceUnavailable)
+		return
+	}
+	json.NewEncoder(w).Encode(nodeStatus{
+		Leader:       string(leaderID),
+		Node:         nodeIDs[0],
+		State:        self.State().String(),
+		AppliedIndex: self.AppliedIndex(),
+	})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// config is the server configuration. It is read from the JSON file given by
+// -config, on top of defaultConfig, and individual flags override it.
+type config struct {
+	Nodes       []clusterMember `json:"nodes"`
+	HTTPAddr    string          `json:"http_addr"`    // client API of the in-process demo
+	Store       string          `json:"store"`        // where nodes keep their Raft log and stable state: "memory" or "file"
+	DataDir     string          `json:"data_dir"`     // each node's log, stable state and snapshots with the "file" store
+	SnapshotDir string          `json:"snapshot_dir"` // each node's snapshots with the "memory" store
+	Forward     string          `json:"forward"`      // how a node passes on requests it cannot serve: "redirect" or "proxy"
+	Timeouts    timeoutConfig   `json:"timeouts"`
+	Snapshots   snapshotConfig  `json:"snapshots"`
+}
+
+// clusterMember describes one node of the cluster.
+type clusterMember struct {
+	ID   string `json:"id"`
+	Raft string `json:"raft"` // TCP address of the node's Raft transport in multi-process mode, reachable by its peers
+	HTTP string `json:"http"` // address of the node's client API in multi-process mode
+}
+
+type timeoutConfig struct {
+	Heartbeat duration `json:"heartbeat"`
+	Election  duration `json:"election"`
+	Commit    duration `json:"commit"`
+	Apply     duration `json:"apply"` // how long a proposed write may wait to be committed
+}
+
+type snapshotConfig struct {
+	Retain      int      `json:"retain"`      // snapshots kept per node
+	Threshold   uint64   `json:"threshold"`   // log entries since the last snapshot that trigger a new one
+	Interval    duration `json:"interval"`    // how often the threshold is checked
+	Compression string   `json:"compression"` // "gzip" or "none"
+}
+
+// duration is a time.Duration written as a string such as "500ms" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"1s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// cfg is the configuration in effect.
+var cfg = defaultConfig()
+
+// defaultConfig is the five-node demo on local ports.
+func defaultConfig() config {
+	c := config{
+		HTTPAddr:    ":8080",
+		Store:       "memory",
+		DataDir:     "data",
+		SnapshotDir: "snapshots",
+		Forward:     "redirect",
+		Timeouts: timeoutConfig{
+			Heartbeat: duration(time.Second),
+			Election:  duration(time.Second),
+			Commit:    duration(500 * time.Millisecond),
+			Apply:     duration(5 * time.Second),
+		},
+		Snapshots: snapshotConfig{
+			Retain:      2,
+			Threshold:   raft.DefaultConfig().SnapshotThreshold,
+			Interval:    duration(raft.DefaultConfig().SnapshotInterval),
+			Compression: "gzip",
+		},
+	}
+	for i := 1; i <= 5; i++ {
+		c.Nodes = append(c.Nodes, clusterMember{
+			ID:   fmt.Sprintf("node%d", i),
+			Raft: fmt.Sprintf("127.0.0.1:%d", 7000+i),
+			HTTP: fmt.Sprintf("127.0.0.1:%d", 8080+i),
+		})
+	}
+	return c
+}
+
+// Flags that override single settings of the configuration.
+var (
+	configFile   = flag.String("config", "", "JSON configuration file; unset fields keep their defaults")
+	storeFlag    = flag.String("store", "", `override "store": "memory" or "file"`)
+	dataDirFlag  = flag.String("data-dir", "", `override "data_dir"`)
+	snapDirFlag  = flag.String("snapshot-dir", "", `override "snapshot_dir"`)
+	httpAddrFlag = flag.String("http-addr", "", `override "http_addr"`)
+	forwardFlag  = flag.String("forward", "", `override "forward": "redirect" or "proxy"`)
+)
+
+// loadConfig builds the configuration from the defaults, the -config file
+// and the override flags, and validates it. flag.Parse must have been called.
+func loadConfig() (config, error) {
+	c := defaultConfig()
+	if *configFile != "" {
+		f, err := os.Open(*configFile)
+		if err != nil {
+			return c, err
+		}
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			return c, fmt.Errorf("%s: %v", *configFile, err)
+		}
+	}
+
+	flag.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "store":
+			c.Store = *storeFlag
+		case "data-dir":
+			c.DataDir = *dataDirFlag
+		case "snapshot-dir":
+			c.SnapshotDir = *snapDirFlag
+		case "http-addr":
+			c.HTTPAddr = *httpAddrFlag
+		case "forward":
+			c.Forward = *forwardFlag
+		}
+	})
+	return c, c.validate()
+}
+
+// validate reports every problem with c at once.
+func (c config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(len(c.Nodes) > 0, "nodes: at least one node is required")
+	ids := make(map[string]bool)
+	addrs := make(map[string]string)
+	for i, m := range c.Nodes {
+		check(m.ID != "", "nodes[%d]: id is required", i)
+		check(!ids[m.ID], "nodes[%d]: duplicate id %q", i, m.ID)
+		ids[m.ID] = true
+		for _, a := range []struct{ field, addr string }{{"raft", m.Raft}, {"http", m.HTTP}} {
+			if _, _, err := net.SplitHostPort(a.addr); err != nil {
+				check(false, "nodes[%d]: invalid %s address %q: %v", i, a.field, a.addr, err)
+				continue
+			}
+			if other, taken := addrs[a.addr]; taken {
+				check(false, "nodes[%d]: %s address %s is already used by %s", i, a.field, a.addr, other)
+			}
+			addrs[a.addr] = m.ID
+		}
+	}
+	_, _, err := net.SplitHostPort(c.HTTPAddr)
+	check(err == nil, "http_addr: invalid address %q", c.HTTPAddr)
+
+	check(c.Store == "memory" || c.Store == "file", `store: want "memory" or "file", got %q`, c.Store)
+	check(c.Forward == "redirect" || c.Forward == "proxy", `forward: want "redirect" or "proxy", got %q`, c.Forward)
+	check(c.Store != "file" || c.DataDir != "", "data_dir is required with the file store")
+	check(c.Store != "memory" || c.SnapshotDir != "", "snapshot_dir is required with the memory store")
+
+	check(c.Timeouts.Apply > 0, "timeouts.apply must be positive")
+	// Followers stand for election once they have not heard from the leader
+	// for the heartbeat timeout, so that is what the lease must stay below.
+	check(time.Duration(c.Timeouts.Heartbeat) > leaderLease, "timeouts.heartbeat must exceed the %v leader lease used by leader-lease reads", leaderLease)
+	if err := raft.ValidateConfig(c.raftConfig("validate")); err != nil {
+		errs = append(errs, fmt.Errorf("timeouts or snapshots: %v", err))
+	}
+
+	check(c.Snapshots.Retain > 0, "snapshots.retain must be at least 1")
+	_, err = c.snapshotCompression()
+	check(err == nil, "snapshots.compression: %v", err)
+	return errors.Join(errs...)
+}
+
+// raftConfig returns the Raft configuration of node id.
+func (c config) raftConfig(id string) *raft.Config {
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(id)
+	rc.HeartbeatTimeout = time.Duration(c.Timeouts.Heartbeat)
+	rc.ElectionTimeout = time.Duration(c.Timeouts.Election)
+	rc.CommitTimeout = time.Duration(c.Timeouts.Commit)
+	rc.LeaderLeaseTimeout = min(rc.LeaderLeaseTimeout, rc.HeartbeatTimeout)
+	rc.SnapshotThreshold = c.Snapshots.Threshold
+	rc.SnapshotInterval = time.Duration(c.Snapshots.Interval)
+	return rc
+}
+
+// snapshotCompression maps the configured compression to its format byte.
+func (c config) snapshotCompression() (byte, error) {
+	switch c.Snapshots.Compression {
+	case "gzip":
+		return compressionGzip, nil
+	case "none":
+		return compressionNone, nil
+	}
+	return 0, fmt.Errorf(`want "gzip" or "none", got %q`, c.Snapshots.Compression)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+// addToCounter adds delta to the integer stored under key, treating a
+// missing key as zero. The key keeps its expiry deadline. The caller must
+// hold f.mu.
+func (f *fsm) addToCounter(key string, delta int64) *applyResult {
+	var current int64
+	prev, existed := f.store.get(key)
+	if existed {
+		n, err := strconv.ParseInt(prev, 10, 64)
+		if err != nil {
+			return f.reject(codeNotNumeric, "value of key %q is not an integer", key).withPrev(prev, existed)
+		}
+		current = n
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return f.reject(codeOverflow, "counter %q would overflow", key).withPrev(prev, existed)
+	}
+
+	next := strconv.FormatInt(current+delta, 10)
+	expiresAt, _ := f.expires.get(key)
+	f.put(key, next, expiresAt)
+	res := f.result().withPrev(prev, existed)
+	res.Value = &next
+	return res
+}
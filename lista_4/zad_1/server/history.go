@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errCompacted is returned when a read asks for a revision whose history has
+// already been pruned.
+var errCompacted = errors.New("requested revision has been compacted")
+
+// errFutureRevision is returned when a read asks for a revision that has not
+// been applied yet, whose answer could still change.
+var errFutureRevision = errors.New("requested revision has not been reached yet")
+
+// version is the value of a key as written at a given log index.
+type version struct {
+	Index   uint64 `json:"index"`
+	Value   string `json:"value,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"` // tombstone left by a delete
+}
+
+// keyHistory holds the retained versions of one key, oldest first.
+type keyHistory struct {
+	Versions []version `json:"versions"`
+	Floor    uint64    `json:"floor,omitempty"` // older versions were dropped to stay within historyLimit
+}
+
+// record appends v to the history of key, dropping the oldest version once
+// historyLimit is exceeded. The previous history is left untouched for
+// snapshots that still share it. The caller must hold f.mu.
+func (f *fsm) record(key string, v version) {
+	next := &keyHistory{}
+	if h, ok := f.history.get(key); ok {
+		next.Versions = append(next.Versions, h.Versions...)
+		next.Floor = h.Floor
+	}
+	next.Versions = append(next.Versions, v)
+	if len(next.Versions) > historyLimit {
+		next.Versions = next.Versions[len(next.Versions)-historyLimit:]
+		next.Floor = next.Versions[0].Index
+	}
+	f.history.set(key, next)
+}
+
+// readAt returns the version of key as of revision, where zero means the
+// latest revision and revisions not applied yet are rejected with
+// errFutureRevision. expiresAt is only reported for latest reads. ok is false
+// if the key did not exist at that revision.
+func (f *fsm) readAt(key string, revision uint64) (v version, expiresAt int64, ok bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if revision == 0 {
+		revision = f.revision
+		expiresAt, _ = f.expires.get(key)
+	}
+	if revision > f.revision {
+		return version{}, 0, false, fmt.Errorf("%w (current revision is %d)", errFutureRevision, f.revision)
+	}
+	if revision < f.compacted {
+		return version{}, 0, false, errCompacted
+	}
+	h, found := f.history.get(key)
+	if !found {
+		return version{}, 0, false, nil
+	}
+	if revision < h.Floor {
+		return version{}, 0, false, errCompacted
+	}
+	for i := len(h.Versions) - 1; i >= 0; i-- {
+		if v = h.Versions[i]; v.Index <= revision {
+			return v, expiresAt, !v.Deleted, nil
+		}
+	}
+	return version{}, 0, false, nil
+}
+
+// compact discards every version that is no longer needed to answer reads at
+// or above revision. The caller must hold f.mu.
+func (f *fsm) compact(revision uint64) error {
+	if revision > f.revision {
+		return fmt.Errorf("cannot compact to future revision %d (current revision is %d)", revision, f.revision)
+	}
+	if revision <= f.compacted {
+		return nil
+	}
+	f.compacted = revision
+
+	f.history.each(func(key string, h *keyHistory) bool {
+		// Keep the newest version at or below revision, since it is still
+		// the answer for reads at revision, and everything after it.
+		base := 0
+		for i, v := range h.Versions {
+			if v.Index <= revision {
+				base = i
+			}
+		}
+		versions := h.Versions[base:]
+		if len(versions) > 0 && versions[0].Deleted && versions[0].Index <= revision {
+			versions = versions[1:]
+		}
+		switch {
+		case len(versions) == 0:
+			f.history.delete(key)
+		case len(versions) < len(h.Versions):
+			f.history.set(key, &keyHistory{Versions: append([]version(nil), versions...), Floor: h.Floor})
+		}
+		return true
+	})
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// transferTimeout is how long a leadership transfer may take before the
+// caller gives up waiting for the new leader.
+const transferTimeout = 5 * time.Second
+
+// transferLeadershipHandler hands leadership over to the voter named by
+// node_id or, if none is named, to the most up-to-date voter.
+func transferLeadershipHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		NodeID string `json:"node_id,omitempty"` // target; any voter if empty
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	leader := getLeader()
+	if leader == nil {
+		http.Error(w, "no leader elected", http.StatusServiceUnavailable)
+		return
+	}
+
+	previous := leaderIDOf(leader)
+	target := req.NodeID
+	if target == "" && *nodeFlag == "" {
+		// Stopped nodes of the demo are still voters, and Raft may pick one.
+		voters, _, _, err := voterQuorum()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read cluster configuration: %v", err), http.StatusInternalServerError)
+			return
+		}
+		target = successorOf(previous, voters)
+	}
+	newLeader, err := transferLeadership(leader, target)
+	if err != nil {
+		status := http.StatusInternalServerError
+		var merr *membershipError
+		if errors.As(err, &merr) {
+			status = merr.status
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":         "Leadership transferred",
+		"previous_leader": previous,
+		"leader":          newLeader,
+	})
+}
+
+// leaderIDOf returns the ID of the given leader.
+func leaderIDOf(leader *raft.Raft) string {
+	_, id := leader.LeaderWithID()
+	return string(id)
+}
+
+// transferLeadership asks leader to step down in favour of target, or of the
+// most up-to-date voter if target is empty, and waits until it knows the new
+// leader, whose ID it returns.
+func transferLeadership(leader *raft.Raft, target string) (string, error) {
+	self := leaderIDOf(leader)
+	var future raft.Future
+	if target == "" {
+		future = leader.LeadershipTransfer()
+	} else {
+		server, found, err := findServer(leader, target)
+		switch {
+		case err != nil:
+			return "", err
+		case !found:
+			return "", rejectChange(http.StatusNotFound, "node %q is not a member", target)
+		case server.Suffrage != raft.Voter:
+			return "", rejectChange(http.StatusConflict, "node %q is not a voter and cannot lead", target)
+		case target == self:
+			return "", rejectChange(http.StatusConflict, "node %q is already the leader", target)
+		}
+		future = leader.LeadershipTransferToServer(server.ID, server.Address)
+	}
+	if err := future.Error(); err != nil {
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipTransferInProgress {
+			return "", rejectChange(http.StatusServiceUnavailable, "%v", err)
+		}
+		return "", fmt.Errorf("failed to transfer leadership: %v", err)
+	}
+
+	// The old leader has stepped down; it learns the new one from its first
+	// heartbeat.
+	deadline := time.Now().Add(transferTimeout)
+	for {
+		if id := leaderIDOf(leader); id != "" && id != self {
+			return id, nil
+		}
+		if time.Now().After(deadline) {
+			return "", rejectChange(http.StatusServiceUnavailable, "leadership was handed over but no new leader has been seen yet")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import "log"
+
+// lease is a held distributed lock.
+type lease struct {
+	Owner     string `json:"owner"`
+	Token     uint64 `json:"token"`      // fencing token: log index of the acquisition
+	ExpiresAt int64  `json:"expires_at"` // deadline in Unix milliseconds, stamped by the leader
+}
+
+// acquireLock grants the lock name to owner unless someone else holds it. A
+// holder acquiring again keeps its token and extends its lease. The caller
+// must hold f.mu.
+func (f *fsm) acquireLock(name, owner string, expiresAt int64) *applyResult {
+	l, held := f.locks.get(name)
+	switch {
+	case !held:
+		l = &lease{Owner: owner, Token: f.revision, ExpiresAt: expiresAt}
+		f.locks.set(name, l)
+		log.Printf("[Node %s] Lock %q acquired by %q with token %d", f.nodeID, name, owner, l.Token)
+	case l.Owner == owner:
+		l = f.extendLease(name, l, expiresAt)
+	default:
+		return f.rejectLock(codeLockHeld, l, "lock %q is held by %q", name, l.Owner)
+	}
+	res := f.result()
+	res.Token, res.ExpiresAt = l.Token, l.ExpiresAt
+	return res
+}
+
+// renewLock extends the lease on name if it is still held by owner with the
+// given token. The caller must hold f.mu.
+func (f *fsm) renewLock(name, owner string, token uint64, expiresAt int64) *applyResult {
+	l, held := f.locks.get(name)
+	if !held {
+		return f.reject(codeNotLockHolder, "lock %q is not held", name)
+	}
+	if l.Owner != owner || l.Token != token {
+		return f.rejectLock(codeNotLockHolder, l, "lock %q is held by %q with another token", name, l.Owner)
+	}
+	l = f.extendLease(name, l, expiresAt)
+	res := f.result()
+	res.Token, res.ExpiresAt = l.Token, l.ExpiresAt
+	return res
+}
+
+// releaseLock frees name if it is held by owner with the given token. The
+// caller must hold f.mu.
+func (f *fsm) releaseLock(name, owner string, token uint64) *applyResult {
+	l, held := f.locks.get(name)
+	if !held {
+		return f.reject(codeNotLockHolder, "lock %q is not held", name)
+	}
+	if l.Owner != owner || l.Token != token {
+		return f.rejectLock(codeNotLockHolder, l, "lock %q is held by %q with another token", name, l.Owner)
+	}
+	f.locks.delete(name)
+	log.Printf("[Node %s] Lock %q released by %q", f.nodeID, name, owner)
+	res := f.result()
+	res.Token = l.Token
+	return res
+}
+
+// extendLease replaces the lease on name with a copy of l that expires at
+// expiresAt, leaving l untouched for snapshots that still share it. The
+// caller must hold f.mu.
+func (f *fsm) extendLease(name string, l *lease, expiresAt int64) *lease {
+	extended := *l
+	extended.ExpiresAt = expiresAt
+	f.locks.set(name, &extended)
+	return &extended
+}
+
+// rejectLock reports a rejected lock operation together with the current
+// lease. The caller must hold f.mu.
+func (f *fsm) rejectLock(code string, l *lease, format string, args ...interface{}) *applyResult {
+	res := f.reject(code, format, args...)
+	res.Token, res.Holder, res.ExpiresAt = l.Token, l.Owner, l.ExpiresAt
+	return res
+}
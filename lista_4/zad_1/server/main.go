@@ -3,12 +3,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
@@ -20,94 +24,369 @@ import (
 
 // Add these constants after the imports
 const (
-	snapshotDir         = "snapshots"
-	retainSnapshotCount = 2
+	expireInterval = 1 * time.Second  // how often the leader looks for expired keys
+	historyLimit   = 16               // versions retained per key for historical reads
+	logCacheSize   = 512              // recent log entries kept in memory in front of a file log store
+	catchUpTimeout = 10 * time.Second // how long a started node is given to catch up before reporting
 )
 
 // command represents a client operation.
 type command struct {
-	Op    string `json:"op"`              // "set" or "get"
-	Key   string `json:"key"`             // key name
-	Value string `json:"value,omitempty"` // value (only for "set")
+	Op           string  `json:"op"`                      // "set", "get", "delete", "cas", "txn", "incr", "decr", "expire", "compact", "lock", "renew" or "unlock"
+	Key          string  `json:"key"`                     // key name, or lock name for lock operations
+	Value        string  `json:"value,omitempty"`         // value (for "set" and "cas")
+	Expected     *string `json:"expected,omitempty"`      // expected current value for "cas"; nil means the key must not exist
+	Ops          []txnOp `json:"ops,omitempty"`           // operations (only for "txn")
+	TTL          int64   `json:"ttl,omitempty"`           // time to live in seconds (for "set", "lock" and "renew")
+	ExpiresAt    int64   `json:"expires_at,omitempty"`    // deadline in Unix milliseconds, stamped by the leader from TTL
+	Now          int64   `json:"now,omitempty"`           // leader's clock in Unix milliseconds (only for "expire")
+	Revision     uint64  `json:"revision,omitempty"`      // read as of this log index ("get") or prune history below it ("compact")
+	Owner        string  `json:"owner,omitempty"`         // lock owner (for lock operations)
+	Token        uint64  `json:"token,omitempty"`         // fencing token (for "renew" and "unlock")
+	Delta        int64   `json:"delta,omitempty"`         // amount for "incr" and "decr"; defaults to 1
+	Consistency  string  `json:"consistency,omitempty"`   // read consistency level (only for "get"); defaults to "linearizable"
+	Node         string  `json:"node,omitempty"`          // node to read from (only for stale reads)
+	MaxStaleness string  `json:"max_staleness,omitempty"` // bound on the node's last contact with the leader, e.g. "2s" (only for stale reads)
+	ClientID     string  `json:"client_id,omitempty"`     // client session of a write, for deduplicating retries
+	Seq          uint64  `json:"seq,omitempty"`           // sequence number of the write within its client session
+}
+
+// getResponse is the body returned for a successful "get".
+type getResponse struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Revision  uint64 `json:"revision"` // log index at which the value was written
+	ExpiresAt string `json:"expires_at,omitempty"`
+	readInfo
+}
+
+// txnOp is a single operation inside a "txn" command.
+type txnOp struct {
+	Op       string  `json:"op"`                 // "check", "get", "set" or "delete"
+	Key      string  `json:"key"`                // key name
+	Value    string  `json:"value,omitempty"`    // value (only for "set")
+	Expected *string `json:"expected,omitempty"` // expected value for "check"; nil means the key must not exist
+}
+
+// txnOpResult reports the outcome of a single txnOp.
+type txnOpResult struct {
+	Op    string  `json:"op"`
+	Key   string  `json:"key"`
+	OK    bool    `json:"ok"`              // guard held, key found or write applied
+	Value *string `json:"value,omitempty"` // value read by "get" or found by a failed "check"
+}
+
+// validateTxn rejects transactions that could not be applied, before they are
+// proposed to the log.
+func validateTxn(ops []txnOp) error {
+	if len(ops) == 0 {
+		return fmt.Errorf("transaction has no operations")
+	}
+	for i, op := range ops {
+		switch op.Op {
+		case "check", "get", "set", "delete":
+		default:
+			return fmt.Errorf("operation %d: unknown transaction operation %q", i, op.Op)
+		}
+	}
+	return nil
 }
 
 // fsm is our simple finite state machine (in-memory key/value store).
+//
+// The replicated state is held in treeMaps, so Snapshot captures it in O(1)
+// and Persist streams it out while Apply keeps writing.
 type fsm struct {
-	mu     sync.Mutex
-	store  map[string]string
+	mu       sync.Mutex
+	store    treeMap[string] // values in key order, also walked by scans
+	expires  treeMap[int64]  // expiry deadlines in Unix milliseconds, only for keys set with a TTL
+	locks    treeMap[*lease]
+	sessions treeMap[*session] // latest write result per client, for deduplicating retries
+
+	history   treeMap[*keyHistory] // retained versions of every key, including deleted ones
+	revision  uint64               // log index of the last applied command
+	compacted uint64               // history below this revision has been pruned
+
+	// Node-local state. It is never written to snapshots, so installing a
+	// snapshot taken on another node leaves it alone.
+	events      []event               // recently applied changes, oldest first
+	eventsFloor uint64                // events below this index are not in the buffer
+	watchers    map[*watcher]struct{} // active watches, notified from Apply
+
 	nodeID string // Add this field
 }
 
 func newFSM(nodeID string) *fsm { // Modify function signature
 	return &fsm{
-		store:  make(map[string]string),
-		nodeID: nodeID, // Set the node ID
+		watchers: make(map[*watcher]struct{}),
+		nodeID:   nodeID, // Set the node ID
 	}
 }
 
-// Apply applies a Raft log entry to the FSM.
+// Apply applies a Raft log entry to the FSM. It always returns an
+// *applyResult describing the outcome.
 func (f *fsm) Apply(l *raft.Log) interface{} {
+	// Every command is applied in a single critical section so readers never
+	// observe a partially applied entry.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Writes made by this entry are stamped with its log index.
+	f.revision = l.Index
+
 	var c command
 	if err := json.Unmarshal(l.Data, &c); err != nil {
 		log.Printf("[Node %s] failed to unmarshal command: %v", f.nodeID, err)
-		return nil
+		return f.reject(codeBadCommand, "failed to decode command: %v", err)
+	}
+
+	if c.ClientID == "" {
+		return f.apply(c)
+	}
+	if res := f.deduplicate(c); res != nil {
+		return res
 	}
+	res := f.apply(c)
+	f.remember(c, res)
+	return res
+}
+
+// apply executes a decoded command. The caller must hold f.mu.
+func (f *fsm) apply(c command) *applyResult {
 	switch c.Op {
 	case "set":
-		f.mu.Lock()
-		f.store[c.Key] = c.Value
-		f.mu.Unlock()
+		prev, existed := f.store.get(c.Key)
+		f.put(c.Key, c.Value, c.ExpiresAt)
 		log.Printf("[Node %s] Set key %q to %q", f.nodeID, c.Key, c.Value)
+		return f.result().withPrev(prev, existed)
+	case "delete":
+		prev, existed := f.store.get(c.Key)
+		f.remove(c.Key)
+		log.Printf("[Node %s] Deleted key %q", f.nodeID, c.Key)
+		return f.result().withPrev(prev, existed)
+	case "cas":
+		prev, existed := f.store.get(c.Key)
+		if !f.matches(c.Key, c.Expected) {
+			log.Printf("[Node %s] CAS on key %q rejected", f.nodeID, c.Key)
+			return f.reject(codePrecondition, "key %q does not hold the expected value", c.Key).withPrev(prev, existed)
+		}
+		f.put(c.Key, c.Value, 0)
+		log.Printf("[Node %s] CAS set key %q to %q", f.nodeID, c.Key, c.Value)
+		return f.result().withPrev(prev, existed)
+	case "txn":
+		return f.applyTxn(c.Ops)
+	case "incr":
+		res := f.addToCounter(c.Key, c.Delta)
+		log.Printf("[Node %s] Incremented key %q by %d", f.nodeID, c.Key, c.Delta)
+		return res
+	case "decr":
+		res := f.addToCounter(c.Key, -c.Delta)
+		log.Printf("[Node %s] Decremented key %q by %d", f.nodeID, c.Key, c.Delta)
+		return res
+	case "expire":
+		// Deadlines are compared against the clock the leader recorded in
+		// the entry, so every replica drops the same keys at the same index.
+		f.expires.each(func(key string, deadline int64) bool {
+			if deadline <= c.Now {
+				f.remove(key)
+				log.Printf("[Node %s] Expired key %q", f.nodeID, key)
+			}
+			return true
+		})
+		f.locks.each(func(name string, l *lease) bool {
+			if l.ExpiresAt <= c.Now {
+				f.locks.delete(name)
+				log.Printf("[Node %s] Lease on lock %q held by %q expired", f.nodeID, name, l.Owner)
+			}
+			return true
+		})
+		return f.result()
+	case "compact":
+		if err := f.compact(c.Revision); err != nil {
+			log.Printf("[Node %s] Compaction to revision %d rejected: %v", f.nodeID, c.Revision, err)
+			return f.reject(codeInvalidRevision, "%v", err)
+		}
+		log.Printf("[Node %s] Compacted history to revision %d", f.nodeID, c.Revision)
+		return f.result()
+	case "lock":
+		return f.acquireLock(c.Key, c.Owner, c.ExpiresAt)
+	case "renew":
+		return f.renewLock(c.Key, c.Owner, c.Token, c.ExpiresAt)
+	case "unlock":
+		return f.releaseLock(c.Key, c.Owner, c.Token)
 	}
-	return nil
+	return f.reject(codeUnknownOp, "unknown operation %q", c.Op)
 }
 
-// Snapshot creates a point-in-time snapshot of the FSM.
-func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+// put stores value under key, replacing any previous expiry deadline with
+// expiresAt (zero means the key never expires). The caller must hold f.mu.
+func (f *fsm) put(key, value string, expiresAt int64) {
+	f.store.set(key, value)
+	f.record(key, version{Index: f.revision, Value: value})
+	f.notify(event{Type: "set", Key: key, Value: value, Index: f.revision})
+	if expiresAt > 0 {
+		f.expires.set(key, expiresAt)
+	} else {
+		f.expires.delete(key)
+	}
+}
+
+// remove deletes key and its expiry deadline. The caller must hold f.mu.
+func (f *fsm) remove(key string) {
+	if _, ok := f.store.get(key); ok {
+		f.store.delete(key)
+		f.record(key, version{Index: f.revision, Deleted: true})
+		f.notify(event{Type: "delete", Key: key, Index: f.revision})
+	}
+	f.expires.delete(key)
+}
+
+// hasExpired reports whether any key's or lease's deadline is at or before now.
+func (f *fsm) hasExpired(now int64) bool {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	// Create a copy of the store.
-	clone := make(map[string]string)
-	for k, v := range f.store {
-		clone[k] = v
+	expired := false
+	f.expires.each(func(_ string, deadline int64) bool {
+		expired = deadline <= now
+		return !expired
+	})
+	f.locks.each(func(_ string, l *lease) bool {
+		expired = expired || l.ExpiresAt <= now
+		return !expired
+	})
+	return expired
+}
+
+// matches reports whether key currently holds expected, or is absent when
+// expected is nil. The caller must hold f.mu.
+func (f *fsm) matches(key string, expected *string) bool {
+	current, ok := f.store.get(key)
+	if expected == nil {
+		return !ok
+	}
+	return ok && current == *expected
+}
+
+// applyTxn evaluates every "check" guard against the current state and, only
+// if all of them hold, applies the remaining operations in order. The caller
+// must hold f.mu.
+func (f *fsm) applyTxn(ops []txnOp) *applyResult {
+	res := f.result()
+	res.Results = make([]txnOpResult, len(ops))
+	failed := 0
+	for i, op := range ops {
+		res.Results[i] = txnOpResult{Op: op.Op, Key: op.Key}
+		if op.Op != "check" {
+			continue
+		}
+		if f.matches(op.Key, op.Expected) {
+			res.Results[i].OK = true
+			continue
+		}
+		failed++
+		if current, ok := f.store.get(op.Key); ok {
+			res.Results[i].Value = &current
+		}
+	}
+	if failed > 0 {
+		log.Printf("[Node %s] Transaction of %d operations rejected", f.nodeID, len(ops))
+		rejected := f.reject(codePrecondition, "%d of the transaction's checks failed", failed)
+		rejected.Results = res.Results
+		return rejected
+	}
+
+	for i, op := range ops {
+		switch op.Op {
+		case "get":
+			if value, ok := f.store.get(op.Key); ok {
+				res.Results[i].OK = true
+				res.Results[i].Value = &value
+			}
+		case "set":
+			f.put(op.Key, op.Value, 0)
+			res.Results[i].OK = true
+		case "delete":
+			_, res.Results[i].OK = f.store.get(op.Key)
+			f.remove(op.Key)
+		}
 	}
+	log.Printf("[Node %s] Applied transaction of %d operations", f.nodeID, len(ops))
+	return res
+}
+
+// Snapshot creates a point-in-time snapshot of the FSM. The treeMaps are
+// persistent, so copying them is enough and Apply is only held up briefly.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return &fsmSnapshot{
-		store:  clone,
-		nodeID: f.nodeID,
+		store:     f.store,
+		expires:   f.expires,
+		locks:     f.locks,
+		sessions:  f.sessions,
+		history:   f.history,
+		revision:  f.revision,
+		compacted: f.compacted,
 	}, nil
 }
 
 // Restore restores the FSM from a snapshot.
 func (f *fsm) Restore(rc io.ReadCloser) error {
 	defer rc.Close()
-	var data struct {
-		Store  map[string]string `json:"store"`
-		NodeID string            `json:"nodeID"`
-	}
-	if err := json.NewDecoder(rc).Decode(&data); err != nil {
+	data, err := readSnapshot(rc)
+	if err != nil {
 		return err
 	}
+	if data.History == nil {
+		// Snapshots taken before history was kept only know the current
+		// values, so those become the oldest readable versions.
+		data.History = make(map[string]*keyHistory, len(data.Store))
+		for key, value := range data.Store {
+			data.History[key] = &keyHistory{Versions: []version{{Value: value}}}
+		}
+	}
+	store := treeMapOf(data.Store)
+	expires := treeMapOf(data.Expires)
+	locks := treeMapOf(data.Locks)
+	sessions := treeMapOf(data.Sessions)
+	history := treeMapOf(data.History)
 	f.mu.Lock()
-	f.store = data.Store
-	f.nodeID = data.NodeID
+	f.store = store
+	f.expires = expires
+	f.locks = locks
+	f.sessions = sessions
+	f.history = history
+	f.revision = data.Revision
+	f.compacted = data.Compacted
+	// Changes folded into the snapshot were never seen as events, so
+	// watches cannot continue across the restore.
+	f.closeWatchers()
+	f.events = nil
+	f.eventsFloor = data.Revision + 1
 	f.mu.Unlock()
 	return nil
 }
 
-// fsmSnapshot implements raft.FSMSnapshot.
+// fsmSnapshot implements raft.FSMSnapshot. It holds views of the FSM's
+// treeMaps as they were when it was taken.
 type fsmSnapshot struct {
-	store  map[string]string
-	nodeID string
+	store     treeMap[string]
+	expires   treeMap[int64]
+	locks     treeMap[*lease]
+	sessions  treeMap[*session]
+	history   treeMap[*keyHistory]
+	revision  uint64
+	compacted uint64
 }
 
 // Persist writes the snapshot to the sink.
 func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
-	data := map[string]interface{}{
-		"store":  s.store,
-		"nodeID": s.nodeID,
+	compression, err := cfg.snapshotCompression()
+	if err != nil {
+		sink.Cancel()
+		return err
 	}
-
-	if err := json.NewEncoder(sink).Encode(data); err != nil {
+	if err := writeSnapshot(sink, s, compression); err != nil {
 		sink.Cancel()
 		return err
 	}
@@ -117,10 +396,10 @@ func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 // Release is a no-op.
 func (s *fsmSnapshot) Release() {}
 
-// createRaftNode creates a Raft node with in-memory storage and transport.
-func createRaftNode(id string, transport *raft.InmemTransport, existingFSM *fsm) (*raft.Raft, *fsm, error) {
-	config := raft.DefaultConfig()
-	config.LocalID = raft.ServerID(id)
+// createRaftNode creates a Raft node on the given transport with the
+// configured timeouts, snapshot policy and storage.
+func createRaftNode(id string, transport raft.Transport, existingFSM *fsm) (*raft.Raft, *fsm, error) {
+	config := cfg.raftConfig(id)
 
 	baseLogger := hclog.New(&hclog.LoggerOptions{
 		Name:   "raft-node",
@@ -131,12 +410,11 @@ func createRaftNode(id string, transport *raft.InmemTransport, existingFSM *fsm)
 	filteredLogger := logger.New(baseLogger)
 	config.Logger = filteredLogger
 
-	config.HeartbeatTimeout = 1000 * time.Millisecond
-	config.ElectionTimeout = 1000 * time.Millisecond
-	config.CommitTimeout = 500 * time.Millisecond
-
 	// Create node-specific snapshot directory
-	nodeSnapshotDir := filepath.Join(snapshotDir, id)
+	nodeSnapshotDir := filepath.Join(cfg.SnapshotDir, id)
+	if cfg.Store == "file" {
+		nodeSnapshotDir = filepath.Join(cfg.DataDir, id) // the snapshot store adds its own "snapshots" directory
+	}
 	if err := os.MkdirAll(nodeSnapshotDir, 0755); err != nil {
 		return nil, nil, fmt.Errorf("failed to create snapshot directory: %v", err)
 	}
@@ -148,25 +426,106 @@ func createRaftNode(id string, transport *raft.InmemTransport, existingFSM *fsm)
 		f = newFSM(id)
 	}
 
-	logStore := raft.NewInmemStore()
-	stableStore := raft.NewInmemStore()
-
-	// Use FileSnapshotStore instead of InmemSnapshotStore
-	snapshotStore, err := raft.NewFileSnapshotStore(nodeSnapshotDir, retainSnapshotCount, os.Stderr)
+	// Use FileSnapshotStore instead of InmemSnapshotStore. It is created
+	// before the log store is opened, so a failure leaves nothing open.
+	snapshotStore, err := raft.NewFileSnapshotStore(nodeSnapshotDir, cfg.Snapshots.Retain, os.Stderr)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create snapshot store: %v", err)
 	}
 
+	logStore, stableStore, err := openStores(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	r, err := raft.NewRaft(config, f, logStore, stableStore, snapshotStore, transport)
 	if err != nil {
+		closeStores(id)
 		return nil, nil, err
 	}
+	go runExpirer(r, f)
 	return r, f, nil
 }
 
+// openStores returns the log and stable store of node id. With the file
+// store they are kept under cfg.DataDir and stay open until closeStores is
+// called.
+// Otherwise the node keeps the same in-memory store for as long as the
+// process runs, so a stopped node rejoins with the log it had.
+func openStores(id string) (raft.LogStore, raft.StableStore, error) {
+	if cfg.Store != "file" {
+		store, ok := memStores[id]
+		if !ok {
+			store = raft.NewInmemStore()
+			memStores[id] = store
+		}
+		return store, store, nil
+	}
+
+	dir := filepath.Join(cfg.DataDir, id, "raft")
+	logStore, err := newFileLogStore(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open log store: %v", err)
+	}
+	stableStore, err := newFileStableStore(filepath.Join(dir, "stable.json"))
+	if err != nil {
+		logStore.Close()
+		return nil, nil, fmt.Errorf("failed to open stable store: %v", err)
+	}
+	cached, err := raft.NewLogCache(logCacheSize, logStore)
+	if err != nil {
+		logStore.Close()
+		return nil, nil, err
+	}
+	fileStores[id] = logStore
+	return cached, stableStore, nil
+}
+
+// closeStores closes the files of node id's log store, if it has one. The
+// node must have been shut down.
+func closeStores(id string) {
+	if s, ok := fileStores[id]; ok {
+		if err := s.Close(); err != nil {
+			log.Printf("[Node %s] failed to close log store: %v", id, err)
+		}
+		delete(fileStores, id)
+	}
+}
+
+// runExpirer periodically proposes an "expire" entry while r is the leader and
+// some key in f has passed its deadline. It returns once r is shut down.
+func runExpirer(r *raft.Raft, f *fsm) {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		switch r.State() {
+		case raft.Shutdown:
+			return
+		case raft.Leader:
+		default:
+			continue
+		}
+
+		now := time.Now().UnixMilli()
+		if !f.hasExpired(now) {
+			continue
+		}
+		data, err := json.Marshal(command{Op: "expire", Now: now})
+		if err != nil {
+			log.Printf("[Node %s] failed to marshal expire command: %v", f.nodeID, err)
+			continue
+		}
+		if err := r.Apply(data, time.Duration(cfg.Timeouts.Apply)).Error(); err != nil {
+			log.Printf("[Node %s] failed to apply expire command: %v", f.nodeID, err)
+		}
+	}
+}
+
 // getLeader returns the Raft instance that is currently leader.
-func getLeader(nodes []*raft.Raft) *raft.Raft {
-	for _, r := range nodes {
+func getLeader() *raft.Raft {
+	nodesMu.RLock()
+	defer nodesMu.RUnlock()
+	for _, r := range raftNodes {
 		if r.State() == raft.Leader {
 			return r
 		}
@@ -174,34 +533,86 @@ func getLeader(nodes []*raft.Raft) *raft.Raft {
 	return nil
 }
 
+// fsmFor returns the FSM that belongs to the given Raft node, or nil.
+func fsmFor(node *raft.Raft) *fsm {
+	nodesMu.RLock()
+	defer nodesMu.RUnlock()
+	for i, r := range raftNodes {
+		if r == node {
+			return fsms[i]
+		}
+	}
+	return nil
+}
+
 // Global variables to hold our nodes and (for simplicity) keep a reference to the leader's FSM.
+//
+// Only the handlers that start, stop, add or remove nodes change the node
+// slices. They hold adminMu throughout, so they can read the slices freely,
+// and also take nodesMu for writing while they change them. Everything else
+// reads the slices under nodesMu.
 var (
+	adminMu    sync.Mutex
+	nodesMu    sync.RWMutex
 	raftNodes  []*raft.Raft
-	fsms       []*fsm // one per node; the leader's FSM holds the canonical state
-	nodeIDs    = []string{"node1", "node2", "node3", "node4", "node5"}
-	nodeState  []bool // true if node is running, false if stopped
+	fsms       []*fsm   // one per node; the leader's FSM holds the canonical state
+	nodeIDs    []string // IDs of the nodes run by this process
+	nodeState  []bool   // true if node is running, false if stopped
 	transports []*raft.InmemTransport
 	addresses  []raft.ServerAddress
+	fileStores = make(map[string]*fileLogStore)    // open log stores by node ID, only with the file store
+	memStores  = make(map[string]*raft.InmemStore) // log and stable store by node ID, only with the memory store
+
+	fresh    = flag.Bool("fresh", false, "wipe existing node data instead of recovering from it")
+	joinFlag = flag.Bool("join", false, "with -node, join a running cluster through \"member add\" instead of bootstrapping it")
+	nodeFlag = flag.String("node", "", "run only this node, talking to its peers over TCP, instead of the in-process demo of all configured nodes")
 )
 
-// Add this function before main()
-func cleanSnapshotDirectory() error {
-	if err := os.RemoveAll(snapshotDir); err != nil {
-		return fmt.Errorf("failed to remove snapshots directory: %v", err)
+// cleanDirectory removes dir with everything in it and creates it again
+// empty.
+func cleanDirectory(dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove %s directory: %v", dir, err)
 	}
-	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
-		return fmt.Errorf("failed to create snapshots directory: %v", err)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s directory: %v", dir, err)
 	}
 	return nil
 }
 
 func main() {
+	flag.Parse()
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+	cfg = c
+
 	// Set up standard logging
 	log.SetFlags(log.Ltime | log.Lmicroseconds)
 
-	// Clean snapshots directory before starting
-	if err := cleanSnapshotDirectory(); err != nil {
-		log.Fatalf("failed to clean snapshots directory: %v", err)
+	// Nodes resume from the data they left behind unless asked to start
+	// over. With the memory store only their snapshots survive.
+	if *fresh {
+		dir := cfg.SnapshotDir
+		if cfg.Store == "file" {
+			dir = cfg.DataDir
+		}
+		if *nodeFlag != "" {
+			// Other nodes may share the directory.
+			dir = filepath.Join(dir, *nodeFlag)
+		}
+		if err := cleanDirectory(dir); err != nil {
+			log.Fatalf("failed to start fresh: %v", err)
+		}
+	}
+
+	if *nodeFlag != "" {
+		log.Fatal(runNode(*nodeFlag))
+	}
+
+	for _, m := range cfg.Nodes {
+		nodeIDs = append(nodeIDs, m.ID)
 	}
 
 	// Initialize nodeState
@@ -210,9 +621,11 @@ func main() {
 		nodeState[i] = true
 	}
 
-	// Create 5 Raft nodes with in-memory transports.
+	// Create the configured Raft nodes with in-memory transports. Each node
+	// is addressed by its ID, so the configuration in a durable log stays
+	// valid across restarts.
 	for _, id := range nodeIDs {
-		addr, trans := raft.NewInmemTransport("")
+		addr, trans := raft.NewInmemTransport(raft.ServerAddress(id))
 		addresses = append(addresses, addr)
 		transports = append(transports, trans)
 		r, f, err := createRaftNode(id, trans, nil)
@@ -233,6 +646,17 @@ func main() {
 		}
 	}
 
+	// Raft has already restored every node's FSM from its latest snapshot
+	// and will replay the committed log after it. A cluster with any such
+	// state must not be bootstrapped again.
+	recovered := false
+	for i, r := range raftNodes {
+		if index := r.LastIndex(); index > 0 {
+			log.Printf("[Node %s] Recovered existing state up to index %d", nodeIDs[i], index)
+			recovered = true
+		}
+	}
+
 	// Bootstrap the cluster using the first node.
 	configuration := raft.Configuration{
 		Servers: []raft.Server{},
@@ -243,21 +667,108 @@ func main() {
 			Address: addr,
 		})
 	}
-	bootstrapFuture := raftNodes[0].BootstrapCluster(configuration)
-	if err := bootstrapFuture.Error(); err != nil && err != raft.ErrCantBootstrap {
-		log.Fatalf("failed to bootstrap cluster: %v", err)
+	if recovered {
+		log.Println("Existing cluster state found, skipping bootstrap")
+	} else {
+		bootstrapFuture := raftNodes[0].BootstrapCluster(configuration)
+		if err := bootstrapFuture.Error(); err != nil && err != raft.ErrCantBootstrap {
+			log.Fatalf("failed to bootstrap cluster: %v", err)
+		}
 	}
 
 	// Wait a moment for election to settle.
 	time.Sleep(2 * time.Second)
+	if recovered && getLeader() == nil {
+		log.Println("No leader elected from the recovered state yet; if too few nodes had data, restart with -fresh")
+	}
 
 	// Start an HTTP server to handle client requests.
 	http.HandleFunc("/command", commandHandler)
+	http.HandleFunc("/mget", mgetHandler)
+	http.HandleFunc("/mset", msetHandler)
+	http.HandleFunc("/scan", scanHandler)
+	http.HandleFunc("/watch", watchHandler)
 	http.HandleFunc("/leader", leaderHandler)
 	http.HandleFunc("/stop", stopNodeHandler)
 	http.HandleFunc("/start", startNodeHandler) // Add this line
-	log.Println("Server is listening on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	http.HandleFunc("/transfer-leadership", transferLeadershipHandler)
+	http.HandleFunc("/members", membersHandler)
+	http.HandleFunc("/member/add", memberHandler(addMember))
+	http.HandleFunc("/member/remove", memberHandler(removeMember))
+	http.HandleFunc("/member/promote", memberHandler(promoteMember))
+	http.HandleFunc("/member/demote", memberHandler(demoteMember))
+	log.Printf("Server is listening on %s", cfg.HTTPAddr)
+	log.Fatal(http.ListenAndServe(cfg.HTTPAddr, nil))
+}
+
+// prepareWrite validates a write command before it is proposed and stamps
+// the fields the leader fills in. It returns a non-nil result if the command
+// must be rejected.
+func prepareWrite(cmd *command) *applyResult {
+	if (cmd.ClientID == "") != (cmd.Seq == 0) {
+		return badCommand(codeBadCommand, "client_id and seq must be given together")
+	}
+
+	switch cmd.Op {
+	case "txn":
+		if err := validateTxn(cmd.Ops); err != nil {
+			return badCommand(codeBadCommand, "%v", err)
+		}
+	case "compact":
+		if cmd.Revision == 0 {
+			return badCommand(codeInvalidRevision, "compact requires a revision")
+		}
+	case "incr", "decr":
+		if cmd.Delta == 0 {
+			cmd.Delta = 1
+		}
+		if cmd.Delta == math.MinInt64 {
+			return badCommand(codeBadCommand, "delta out of range")
+		}
+	case "lock", "renew", "unlock":
+		if cmd.Key == "" || cmd.Owner == "" {
+			return badCommand(codeBadCommand, "%s requires a lock name and an owner", cmd.Op)
+		}
+		if cmd.Op != "unlock" && cmd.TTL <= 0 {
+			return badCommand(codeBadCommand, "%s requires a positive lease ttl", cmd.Op)
+		}
+	}
+
+	// Turn a relative TTL into an absolute deadline on the leader, so the
+	// replicated entry means the same thing on every node.
+	cmd.ExpiresAt = 0
+	if (cmd.Op == "set" || cmd.Op == "lock" || cmd.Op == "renew") && cmd.TTL > 0 {
+		cmd.ExpiresAt = time.Now().Add(time.Duration(cmd.TTL) * time.Second).UnixMilli()
+	}
+	return nil
+}
+
+// propose validates a write command and applies it through the leader,
+// returning the outcome reported by the FSM.
+func propose(cmd command) *applyResult {
+	// Determine the leader.
+	leader := getLeader()
+	if leader == nil {
+		return badCommand(codeNotLeader, "no leader elected")
+	}
+	if res := prepareWrite(&cmd); res != nil {
+		return res
+	}
+
+	// For writes, marshal the command and apply it to the leader.
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return badCommand(codeBadCommand, "%v", err)
+	}
+	applyFuture := leader.Apply(data, time.Duration(cfg.Timeouts.Apply))
+	if err := applyFuture.Error(); err != nil {
+		return proposalError(err)
+	}
+	res, ok := applyFuture.Response().(*applyResult)
+	if !ok {
+		return badCommand(codeApplyFailed, "unexpected apply response %T", applyFuture.Response())
+	}
+	return res
 }
 
 // commandHandler forwards write commands to the leader and serves get requests.
@@ -269,51 +780,41 @@ func commandHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Determine the leader.
-	leader := getLeader(raftNodes)
-	if leader == nil {
-		http.Error(w, "no leader elected", http.StatusServiceUnavailable)
-		return
-	}
-
 	switch cmd.Op {
-	case "set":
-		// For writes, marshal the command and apply it to the leader.
-		data, err := json.Marshal(cmd)
+	case "set", "delete", "cas", "txn", "incr", "decr", "compact", "lock", "renew", "unlock":
+		writeResult(w, propose(cmd))
+
+	case "get":
+		// For reads, read from the FSM of a node that is current enough for
+		// the requested consistency level.
+		opts, err := parseReadOptions(cmd.Consistency, cmd.Node, cmd.MaxStaleness)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		applyFuture := leader.Apply(data, 5*time.Second)
-		if err := applyFuture.Error(); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		f, info, err := reader(opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("set successful"))
-
-	case "get":
-		// For reads, read from the leader's FSM state.
-		// (In a real system, you might also allow reads from followers with a read index.)
-		var leaderFSM *fsm
-		for i, r := range raftNodes {
-			if r == leader {
-				leaderFSM = fsms[i]
-				break
-			}
+		v, expiresAt, ok, err := f.readAt(cmd.Key, cmd.Revision)
+		if err == errCompacted {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
 		}
-		if leaderFSM == nil {
-			http.Error(w, "leader FSM not found", http.StatusInternalServerError)
+		if errors.Is(err, errFutureRevision) {
+			writeResult(w, badCommand(codeInvalidRevision, "%v", err))
 			return
 		}
-		leaderFSM.mu.Lock()
-		value, ok := leaderFSM.store[cmd.Key]
-		leaderFSM.mu.Unlock()
 		if !ok {
 			http.Error(w, "key not found", http.StatusNotFound)
 			return
 		}
-		json.NewEncoder(w).Encode(map[string]string{"key": cmd.Key, "value": value})
+		resp := getResponse{Key: cmd.Key, Value: v.Value, Revision: v.Index, readInfo: info}
+		if expiresAt > 0 {
+			resp.ExpiresAt = time.UnixMilli(expiresAt).Format(time.RFC3339)
+		}
+		json.NewEncoder(w).Encode(resp)
 	default:
 		http.Error(w, "unknown operation", http.StatusBadRequest)
 	}
@@ -321,19 +822,21 @@ func commandHandler(w http.ResponseWriter, r *http.Request) {
 
 // Add this new handler function
 func leaderHandler(w http.ResponseWriter, r *http.Request) {
-	leader := getLeader(raftNodes)
+	leader := getLeader()
 	if leader == nil {
 		http.Error(w, "no leader elected", http.StatusServiceUnavailable)
 		return
 	}
 
 	leaderID := string(leader.LastContact().String())
+	nodesMu.RLock()
 	for i, node := range raftNodes {
 		if node == leader {
 			leaderID = nodeIDs[i]
 			break
 		}
 	}
+	nodesMu.RUnlock()
 
 	json.NewEncoder(w).Encode(map[string]string{
 		"leader": leaderID,
@@ -341,15 +844,61 @@ func leaderHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// Add this helper function before stopNodeHandler
-func countRunningNodes() int {
-	count := 0
-	for _, state := range nodeState {
-		if state {
-			count++
+// voterQuorum counts the voters of the cluster configuration that are
+// running in this process and returns it with the number of voters that make
+// a majority. Learners and removed nodes are not voters, so they count
+// neither way. The caller must hold adminMu.
+func voterQuorum() (voters map[string]bool, running, majority int, err error) {
+	node := getLeader()
+	for i := 0; node == nil && i < len(raftNodes); i++ {
+		if nodeState[i] {
+			node = raftNodes[i]
+		}
+	}
+	if node == nil {
+		return nil, 0, 0, errors.New("no running nodes")
+	}
+	future := node.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, 0, 0, err
+	}
+	voters = make(map[string]bool)
+	for _, s := range future.Configuration().Servers {
+		if s.Suffrage == raft.Voter {
+			voters[string(s.ID)] = true
+		}
+	}
+	for i, id := range nodeIDs {
+		if nodeState[i] && voters[id] {
+			running++
+		}
+	}
+	return voters, running, len(voters)/2 + 1, nil
+}
+
+// successorOf picks the running voter other than id with the longest log to
+// take over leadership from id, or "" to leave the choice to Raft, which
+// would also consider stopped nodes since they remain voters. The caller must
+// hold adminMu.
+func successorOf(id string, voters map[string]bool) string {
+	best, bestIndex := "", uint64(0)
+	for i, other := range nodeIDs {
+		if other == id || !nodeState[i] || !voters[other] {
+			continue
+		}
+		if last := raftNodes[i].LastIndex(); best == "" || last > bestIndex {
+			best, bestIndex = other, last
 		}
 	}
-	return count
+	return best
+}
+
+// setRunning records whether the node at index is running. The caller must
+// hold adminMu.
+func setRunning(index int, running bool) {
+	nodesMu.Lock()
+	nodeState[index] = running
+	nodesMu.Unlock()
 }
 
 // Replace the existing stopNodeHandler
@@ -358,6 +907,8 @@ func stopNodeHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	adminMu.Lock()
+	defer adminMu.Unlock()
 
 	var req struct {
 		NodeID string `json:"node_id"`
@@ -386,18 +937,34 @@ func stopNodeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if stopping this node would exceed the limit
-	runningNodes := countRunningNodes()
-	if runningNodes <= 3 { // 3 is the minimum number of nodes we want to keep running
+	// A voter may only be stopped if a majority of the voters keeps
+	// running; learners do not count towards the quorum.
+	voters, running, majority, err := voterQuorum()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read cluster configuration: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if voters[req.NodeID] && running-1 < majority {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Cannot stop more than 2 nodes. At least 3 nodes must be running.",
+			"error": fmt.Sprintf("Cannot stop %s: %d of %d voters would be left running, but a quorum needs %d.", req.NodeID, running-1, len(voters), majority),
 		})
 		return
 	}
 
-	// Take a snapshot before shutting down
+	// Hand leadership over first, so writes only wait for the transfer
+	// instead of an election timeout.
 	raftNode := raftNodes[nodeIndex]
+	message := "Node stopped successfully"
+	if raftNode.State() == raft.Leader {
+		if newLeader, err := transferLeadership(raftNode, successorOf(req.NodeID, voters)); err != nil {
+			log.Printf("[Node %s] Leadership transfer before stopping failed, a new leader will be elected: %v", req.NodeID, err)
+		} else {
+			message = fmt.Sprintf("Node stopped successfully after handing leadership to %s", newLeader)
+		}
+	}
+
+	// Take a snapshot before shutting down
 	snapFuture := raftNode.Snapshot()
 	if err := snapFuture.Error(); err != nil {
 		log.Printf("Warning: failed to create snapshot: %v", err)
@@ -412,9 +979,17 @@ func stopNodeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	nodeState[nodeIndex] = false
+	closeStores(req.NodeID)
+	setRunning(nodeIndex, false)
+
+	// End watches served from the stopped node's FSM.
+	f := fsms[nodeIndex]
+	f.mu.Lock()
+	f.closeWatchers()
+	f.mu.Unlock()
+
 	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Node stopped successfully",
+		"message": message,
 		"node_id": req.NodeID,
 	})
 }
@@ -425,6 +1000,8 @@ func startNodeHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	adminMu.Lock()
+	defer adminMu.Unlock()
 
 	var req struct {
 		NodeID string `json:"node_id"`
@@ -462,35 +1039,24 @@ func startNodeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if we have enough running nodes for a quorum
-	runningNodes := 0
-	for _, state := range nodeState {
-		if state {
-			runningNodes++
-		}
+	if removedNodes[req.NodeID] {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Node was removed from the cluster; add it again with member add",
+		})
+		return
 	}
 
-	if runningNodes < (len(nodeIDs)/2 + 1) {
+	// Check if we have enough running voters for a quorum
+	if _, running, majority, err := voterQuorum(); err != nil || running < majority {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Not enough running nodes to form a quorum. Please start more nodes first.",
+			"error": "Not enough running voters to form a quorum. Please start more nodes first.",
 		})
 		return
 	}
 
-	// Create new transport
-	addr, trans := raft.NewInmemTransport("")
-
-	// Connect transport with all other nodes
-	for i, t := range transports {
-		if i != nodeIndex && nodeState[i] {
-			trans.Connect(addresses[i], t)
-			t.Connect(addr, trans)
-		}
-	}
-
-	// Create new Raft node
-	node, f, err := createRaftNode(nodeIDs[nodeIndex], trans, nil)
+	local, err := launchNode(nodeIndex)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -498,19 +1064,14 @@ func startNodeHandler(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-
-	// Update global state
-	raftNodes[nodeIndex] = node
-	fsms[nodeIndex] = f
-	transports[nodeIndex] = trans
-	addresses[nodeIndex] = addr
-	nodeState[nodeIndex] = true
+	node, addr := raftNodes[nodeIndex], addresses[nodeIndex]
 
 	// Add the node back to the cluster configuration
-	leader := getLeader(raftNodes)
+	leader := getLeader()
 	if leader == nil {
-		node.Shutdown()
-		nodeState[nodeIndex] = false
+		node.Shutdown().Error()
+		closeStores(nodeIDs[nodeIndex])
+		setRunning(nodeIndex, false)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		json.NewEncoder(w).Encode(map[string]string{
 			"error": "No leader available",
@@ -518,16 +1079,18 @@ func startNodeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	future := leader.AddVoter(
-		raft.ServerID(nodeIDs[nodeIndex]),
-		addr,
-		0,
-		0,
-	)
+	// A learner rejoins as a learner; anyone else as a voter.
+	id := raft.ServerID(nodeIDs[nodeIndex])
+	change := leader.AddVoter
+	if server, found, err := findServer(leader, string(id)); err == nil && found && server.Suffrage == raft.Nonvoter {
+		change = leader.AddNonvoter
+	}
+	future := change(id, addr, 0, 0)
 
 	if err := future.Error(); err != nil {
-		node.Shutdown()
-		nodeState[nodeIndex] = false
+		node.Shutdown().Error()
+		closeStores(nodeIDs[nodeIndex])
+		setRunning(nodeIndex, false)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
 			"error": fmt.Sprintf("Failed to join cluster: %v", err),
@@ -535,9 +1098,99 @@ func startNodeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	report := awaitCatchUp(node, local, leader.LastIndex())
+	report.Message = "Node started and joined cluster successfully"
+	report.NodeID = req.NodeID
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Node started and joined cluster successfully",
-		"node_id": req.NodeID,
-	})
+	json.NewEncoder(w).Encode(report)
+}
+
+// launchNode starts the in-process node at nodeIndex again and records it in
+// the global state. The node restores its FSM from its own latest snapshot
+// and keeps its log, so only what it missed comes from the leader. The
+// caller must hold adminMu.
+func launchNode(nodeIndex int) (localState, error) {
+	node, f, trans, err := newInmemNode(nodeIDs[nodeIndex])
+	if err != nil {
+		return localState{}, err
+	}
+
+	nodesMu.Lock()
+	raftNodes[nodeIndex] = node
+	fsms[nodeIndex] = f
+	transports[nodeIndex] = trans
+	addresses[nodeIndex] = trans.LocalAddr()
+	nodeState[nodeIndex] = true
+	nodesMu.Unlock()
+	return localStateOf(node), nil
+}
+
+// newInmemNode creates an in-process node for id on a new transport connected
+// to the running nodes, without recording it in the global state. The caller
+// must hold adminMu.
+func newInmemNode(id string) (*raft.Raft, *fsm, *raft.InmemTransport, error) {
+	addr, trans := raft.NewInmemTransport(raft.ServerAddress(id))
+	for i, t := range transports {
+		if nodeIDs[i] != id && nodeState[i] {
+			trans.Connect(addresses[i], t)
+			t.Connect(addr, trans)
+		}
+	}
+
+	node, f, err := createRaftNode(id, trans, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return node, f, trans, nil
+}
+
+// rejoinReport is the body returned when a stopped node has been started
+// again. It tells apart the entries the node recovered on its own from those
+// the leader had to send.
+type rejoinReport struct {
+	Message            string `json:"message"`
+	NodeID             string `json:"node_id"`
+	RestoredIndex      uint64 `json:"restored_index"`      // index of the node's own snapshot it restored from
+	ReplayedEntries    uint64 `json:"replayed_entries"`    // entries from the node's own log applied after that snapshot
+	TransferredEntries uint64 `json:"transferred_entries"` // entries covered by what the leader sent
+	SnapshotInstalled  bool   `json:"snapshot_installed"`  // the leader sent a snapshot instead of log entries
+	CaughtUp           bool   `json:"caught_up"`           // the node applied everything up to the target before the wait ended
+}
+
+// localState is what a node recovered from its own storage when it started.
+type localState struct {
+	snapshotIndex uint64
+	lastLogIndex  uint64
+}
+
+// localStateOf reads the recovered state of a node that was just created.
+func localStateOf(node *raft.Raft) localState {
+	stats := node.Stats()
+	snapshotIndex, _ := strconv.ParseUint(stats["last_snapshot_index"], 10, 64)
+	lastLogIndex, _ := strconv.ParseUint(stats["last_log_index"], 10, 64)
+	return localState{snapshotIndex: snapshotIndex, lastLogIndex: max(lastLogIndex, snapshotIndex)}
+}
+
+// awaitCatchUp waits until node has applied target, for at most
+// catchUpTimeout, and reports how it got there from local.
+func awaitCatchUp(node *raft.Raft, local localState, target uint64) rejoinReport {
+	deadline := time.Now().Add(catchUpTimeout)
+	for node.AppliedIndex() < target && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	report := rejoinReport{
+		RestoredIndex: local.snapshotIndex,
+		CaughtUp:      node.AppliedIndex() >= target,
+	}
+	after := localStateOf(node)
+	if after.snapshotIndex > local.lastLogIndex {
+		// The leader's snapshot superseded everything the node had.
+		report.SnapshotInstalled = true
+		report.TransferredEntries = target - local.snapshotIndex
+		return report
+	}
+	report.ReplayedEntries = min(local.lastLogIndex, target) - local.snapshotIndex
+	report.TransferredEntries = target - local.snapshotIndex - report.ReplayedEntries
+	return report
 }
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// removedNodes holds the in-process nodes taken out of the cluster with
+// "member remove". They stay stopped until they are added again.
+var removedNodes = make(map[string]bool)
+
+// memberRequest is the body of the membership endpoints.
+type memberRequest struct {
+	NodeID  string `json:"node_id"`
+	Address string `json:"address,omitempty"` // Raft address of a node added in multi-process mode; defaults to its configured one
+}
+
+// memberInfo describes one server of the current Raft configuration.
+type memberInfo struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"` // "Voter" or "Nonvoter"
+	Leader   bool   `json:"leader,omitempty"`
+}
+
+// membersHandler lists the servers of the current configuration.
+func membersHandler(w http.ResponseWriter, r *http.Request) {
+	leader := getLeader()
+	if leader == nil {
+		http.Error(w, "no leader elected", http.StatusServiceUnavailable)
+		return
+	}
+	future := leader.GetConfiguration()
+	if err := future.Error(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, leaderID := leader.LeaderWithID()
+	members := []memberInfo{}
+	for _, s := range future.Configuration().Servers {
+		members = append(members, memberInfo{
+			ID:       string(s.ID),
+			Address:  string(s.Address),
+			Suffrage: s.Suffrage.String(),
+			Leader:   s.ID == leaderID,
+		})
+	}
+	json.NewEncoder(w).Encode(members)
+}
+
+// memberHandler returns the handler of one membership change. Every change
+// is made through the leader and committed as a configuration entry.
+func memberHandler(change func(leader *raft.Raft, req memberRequest) (string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req memberRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NodeID == "" {
+			http.Error(w, "Invalid request body: node_id is required", http.StatusBadRequest)
+			return
+		}
+		adminMu.Lock()
+		defer adminMu.Unlock()
+		leader := getLeader()
+		if leader == nil {
+			http.Error(w, "no leader elected", http.StatusServiceUnavailable)
+			return
+		}
+
+		message, err := change(leader, req)
+		if err != nil {
+			status := http.StatusInternalServerError
+			var merr *membershipError
+			if errors.As(err, &merr) {
+				status = merr.status
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": message,
+			"node_id": req.NodeID,
+		})
+	}
+}
+
+// membershipError is a rejected membership change with its HTTP status.
+type membershipError struct {
+	status int
+	msg    string
+}
+
+func (e *membershipError) Error() string { return e.msg }
+
+func rejectChange(status int, format string, args ...interface{}) error {
+	return &membershipError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+// findServer looks up id in the leader's configuration.
+func findServer(leader *raft.Raft, id string) (raft.Server, bool, error) {
+	future := leader.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return raft.Server{}, false, err
+	}
+	for _, s := range future.Configuration().Servers {
+		if string(s.ID) == id {
+			return s, true, nil
+		}
+	}
+	return raft.Server{}, false, nil
+}
+
+// addMember adds a node as a non-voting learner. In the in-process demo a
+// node with a new ID is created first; in multi-process mode the node must
+// already be running with -join.
+func addMember(leader *raft.Raft, req memberRequest) (string, error) {
+	if _, found, err := findServer(leader, req.NodeID); err != nil {
+		return "", err
+	} else if found {
+		return "", rejectChange(http.StatusConflict, "node %q is already a member", req.NodeID)
+	}
+
+	address := raft.ServerAddress(req.Address)
+	index, isNew := -1, false
+	if *nodeFlag == "" {
+		var err error
+		if index, isNew, err = launchMember(req.NodeID); err != nil {
+			return "", err
+		}
+		address = addresses[index]
+	} else if address == "" {
+		m, ok := memberByID(req.NodeID)
+		if !ok {
+			return "", rejectChange(http.StatusBadRequest, "node %q is not configured; give its Raft address", req.NodeID)
+		}
+		address = raft.ServerAddress(m.Raft)
+	}
+
+	if err := leader.AddNonvoter(raft.ServerID(req.NodeID), address, 0, 0).Error(); err != nil {
+		if index >= 0 {
+			abandonMember(index, isNew)
+		}
+		return "", fmt.Errorf("failed to add learner: %v", err)
+	}
+	delete(removedNodes, req.NodeID)
+	return "Node added as a learner; promote it once it has caught up", nil
+}
+
+// launchMember starts an in-process node for id, which is either new or was
+// removed earlier, and returns its index. A new node is only recorded in the
+// global state once it has been created. The caller must hold adminMu.
+func launchMember(id string) (index int, isNew bool, err error) {
+	for i, existing := range nodeIDs {
+		if existing != id {
+			continue
+		}
+		if nodeState[i] {
+			return 0, false, rejectChange(http.StatusConflict, "node %q is already running", id)
+		}
+		if _, err := launchNode(i); err != nil {
+			return 0, false, fmt.Errorf("failed to create node: %v", err)
+		}
+		return i, false, nil
+	}
+
+	node, f, trans, err := newInmemNode(id)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to create node: %v", err)
+	}
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	nodeIDs = append(nodeIDs, id)
+	raftNodes = append(raftNodes, node)
+	fsms = append(fsms, f)
+	nodeState = append(nodeState, true)
+	transports = append(transports, trans)
+	addresses = append(addresses, trans.LocalAddr())
+	return len(nodeIDs) - 1, true, nil
+}
+
+// abandonMember shuts down the node that launchMember started at index after
+// it could not be added to the configuration, and forgets a new node again.
+// The caller must hold adminMu.
+func abandonMember(index int, isNew bool) {
+	raftNodes[index].Shutdown().Error()
+	closeStores(nodeIDs[index])
+	if !isNew {
+		setRunning(index, false)
+		return
+	}
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	nodeIDs, raftNodes, fsms = nodeIDs[:index], raftNodes[:index], fsms[:index]
+	nodeState, transports, addresses = nodeState[:index], transports[:index], addresses[:index]
+}
+
+// promoteMember makes a learner a voter once it has applied everything the
+// leader had committed when the promotion was asked for.
+func promoteMember(leader *raft.Raft, req memberRequest) (string, error) {
+	server, found, err := findServer(leader, req.NodeID)
+	switch {
+	case err != nil:
+		return "", err
+	case !found:
+		return "", rejectChange(http.StatusNotFound, "node %q is not a member", req.NodeID)
+	case server.Suffrage == raft.Voter:
+		return "", rejectChange(http.StatusConflict, "node %q is already a voter", req.NodeID)
+	}
+
+	target := leader.CommitIndex()
+	deadline := time.Now().Add(catchUpTimeout)
+	for {
+		applied, err := appliedIndexOf(req.NodeID)
+		if err != nil {
+			return "", rejectChange(http.StatusServiceUnavailable, "cannot tell whether node %q has caught up: %v", req.NodeID, err)
+		}
+		if applied >= target {
+			break
+		}
+		if time.Now().After(deadline) {
+			return "", rejectChange(http.StatusConflict, "node %q has applied index %d of %d; try again once it has caught up", req.NodeID, applied, target)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := leader.AddVoter(server.ID, server.Address, 0, 0).Error(); err != nil {
+		return "", fmt.Errorf("failed to promote: %v", err)
+	}
+	return "Node promoted to voter", nil
+}
+
+// appliedIndexOf returns the last index applied by node id, read from the
+// node itself in this process or through its client API.
+func appliedIndexOf(id string) (uint64, error) {
+	for i, existing := range nodeIDs {
+		if existing == id {
+			if !nodeState[i] {
+				return 0, errors.New("node is stopped")
+			}
+			return raftNodes[i].AppliedIndex(), nil
+		}
+	}
+	m, ok := memberByID(id)
+	if !ok {
+		return 0, errors.New("its client API address is not configured")
+	}
+	resp, err := http.Get("http://" + m.HTTP + "/leader")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var status nodeStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, err
+	}
+	return status.AppliedIndex, nil
+}
+
+// demoteMember turns a voter into a learner that keeps receiving the log.
+func demoteMember(leader *raft.Raft, req memberRequest) (string, error) {
+	server, found, err := findServer(leader, req.NodeID)
+	switch {
+	case err != nil:
+		return "", err
+	case !found:
+		return "", rejectChange(http.StatusNotFound, "node %q is not a member", req.NodeID)
+	case server.Suffrage != raft.Voter:
+		return "", rejectChange(http.StatusConflict, "node %q is not a voter", req.NodeID)
+	}
+	if err := leader.DemoteVoter(raft.ServerID(req.NodeID), 0, 0).Error(); err != nil {
+		return "", fmt.Errorf("failed to demote: %v", err)
+	}
+	return "Node demoted to learner", nil
+}
+
+// removeMember takes a node out of the configuration for good. An in-process
+// node is also shut down and will not be started again unless it is added
+// back.
+func removeMember(leader *raft.Raft, req memberRequest) (string, error) {
+	if _, found, err := findServer(leader, req.NodeID); err != nil {
+		return "", err
+	} else if !found {
+		return "", rejectChange(http.StatusNotFound, "node %q is not a member", req.NodeID)
+	}
+	if err := leader.RemoveServer(raft.ServerID(req.NodeID), 0, 0).Error(); err != nil {
+		return "", fmt.Errorf("failed to remove: %v", err)
+	}
+
+	if *nodeFlag != "" {
+		return "Node removed from the cluster; its process can be stopped", nil
+	}
+	for i, id := range nodeIDs {
+		if id != req.NodeID {
+			continue
+		}
+		if nodeState[i] {
+			raftNodes[i].Shutdown().Error()
+			closeStores(id)
+			setRunning(i, false)
+			f := fsms[i]
+			f.mu.Lock()
+			f.closeWatchers()
+			f.mu.Unlock()
+		}
+		removedNodes[id] = true
+	}
+	return "Node removed from the cluster", nil
+}
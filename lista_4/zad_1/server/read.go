@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Read consistency levels accepted by "get" and scans.
+const (
+	consistencyLinearizable = "linearizable" // confirm leadership and wait for committed entries (default)
+	consistencyLeaderLease  = "leader-lease" // read the leader's state while its last confirmation is fresh
+	consistencyStale        = "stale"        // read any running node's state, optionally bounded by max staleness
+)
+
+const (
+	readTimeout = 5 * time.Second
+	// leaderLease is how long a confirmed leadership is trusted without
+	// asking a quorum again. It is kept below the heartbeat timeout, after
+	// which followers start an election, so that no other leader can have
+	// been elected within it.
+	leaderLease = 500 * time.Millisecond
+)
+
+var errNoFreshReplica = errors.New("no running node is within the requested staleness bound")
+
+// readOptions selects how a read is served.
+type readOptions struct {
+	Consistency  string
+	Node         string        // node to serve a stale read from; empty picks any
+	MaxStaleness time.Duration // bound on the node's last contact with the leader; zero means unbounded
+}
+
+// parseReadOptions validates the consistency parameters of a read request.
+func parseReadOptions(consistency, node, maxStaleness string) (readOptions, error) {
+	opts := readOptions{Consistency: consistency, Node: node}
+	switch consistency {
+	case "", consistencyLinearizable, consistencyLeaderLease, consistencyStale:
+	default:
+		return opts, fmt.Errorf("unknown consistency level %q", consistency)
+	}
+	if consistency != consistencyStale && (node != "" || maxStaleness != "") {
+		return opts, fmt.Errorf("node and max_staleness only apply to stale reads")
+	}
+	if maxStaleness != "" {
+		d, err := time.ParseDuration(maxStaleness)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid max_staleness %q", maxStaleness)
+		}
+		opts.MaxStaleness = d
+	}
+	return opts, nil
+}
+
+// readInfo describes the node that served a read.
+type readInfo struct {
+	Node         string `json:"node"`
+	AppliedIndex uint64 `json:"applied_index"`          // last log index applied by the node
+	LastContact  string `json:"last_contact,omitempty"` // time since the node last heard from the leader (stale reads)
+}
+
+// leaderLeases records when each node's leadership was last confirmed by a
+// quorum.
+var leaderLeases = struct {
+	sync.Mutex
+	confirmed map[*raft.Raft]time.Time
+}{confirmed: make(map[*raft.Raft]time.Time)}
+
+// reader returns the FSM that should serve a read with the given options,
+// after making it safe to read at that consistency level.
+func reader(opts readOptions) (*fsm, readInfo, error) {
+	if opts.Consistency == consistencyStale {
+		return staleReader(opts)
+	}
+
+	leader := getLeader()
+	if leader == nil {
+		return nil, readInfo{}, errors.New("no leader elected")
+	}
+	f := fsmFor(leader)
+	if f == nil {
+		return nil, readInfo{}, errors.New("leader FSM not found")
+	}
+	if err := confirmLeadership(leader, opts.Consistency == consistencyLeaderLease); err != nil {
+		return nil, readInfo{}, err
+	}
+	return f, readInfo{Node: f.nodeID, AppliedIndex: leader.AppliedIndex()}, nil
+}
+
+// confirmLeadership makes sure leader has not been deposed and has applied
+// every entry committed before the read began, so the read observes all
+// writes acknowledged before it. With useLease a confirmation obtained within
+// the last leaderLease is reused instead of contacting a quorum again.
+func confirmLeadership(leader *raft.Raft, useLease bool) error {
+	if useLease {
+		leaderLeases.Lock()
+		confirmed := leaderLeases.confirmed[leader]
+		leaderLeases.Unlock()
+		if leader.State() == raft.Leader && time.Since(confirmed) < leaderLease {
+			return nil
+		}
+	}
+
+	// The lease starts when the quorum was asked, not when it answered.
+	start := time.Now()
+	if err := leader.VerifyLeader().Error(); err != nil {
+		return fmt.Errorf("could not verify leadership: %v", err)
+	}
+	if err := leader.Barrier(readTimeout).Error(); err != nil {
+		return fmt.Errorf("could not catch up with the log: %v", err)
+	}
+
+	leaderLeases.Lock()
+	leaderLeases.confirmed[leader] = start
+	leaderLeases.Unlock()
+	return nil
+}
+
+// staleReader picks a running node, the requested one or a random one, whose
+// last contact with the leader is within opts.MaxStaleness.
+func staleReader(opts readOptions) (*fsm, readInfo, error) {
+	nodesMu.RLock()
+	defer nodesMu.RUnlock()
+	var candidates []int
+	for i, id := range nodeIDs {
+		if !nodeState[i] || (opts.Node != "" && id != opts.Node) {
+			continue
+		}
+		candidates = append(candidates, i)
+	}
+	if len(candidates) == 0 {
+		if opts.Node != "" {
+			return nil, readInfo{}, fmt.Errorf("node %q is not running", opts.Node)
+		}
+		return nil, readInfo{}, errors.New("no running nodes")
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	for _, i := range candidates {
+		r := raftNodes[i]
+		var age time.Duration
+		if r.State() != raft.Leader {
+			contact := r.LastContact()
+			if contact.IsZero() {
+				continue
+			}
+			age = time.Since(contact)
+		}
+		if opts.MaxStaleness > 0 && age > opts.MaxStaleness {
+			continue
+		}
+		return fsms[i], readInfo{
+			Node:         nodeIDs[i],
+			AppliedIndex: r.AppliedIndex(),
+			LastContact:  age.Round(time.Millisecond).String(),
+		}, nil
+	}
+	return nil, readInfo{}, errNoFreshReplica
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/hashicorp/raft"
+)
+
+// Values of applyResult.Status.
+const (
+	statusOK       = "ok"       // the command was committed and applied
+	statusRejected = "rejected" // the command was committed but its precondition failed
+	statusError    = "error"    // the command was invalid or could not be committed
+)
+
+// Values of applyResult.Code.
+const (
+	codeBadCommand      = "bad_command"
+	codeUnknownOp       = "unknown_op"
+	codePrecondition    = "precondition_failed"
+	codeNotNumeric      = "not_numeric"
+	codeOverflow        = "overflow"
+	codeInvalidRevision = "invalid_revision"
+	codeLockHeld        = "lock_held"
+	codeNotLockHolder   = "not_lock_holder"
+	codeNotLeader       = "not_leader"
+	codeStaleSequence   = "stale_sequence"
+	codeTimeout         = "timeout"
+	codeApplyFailed     = "apply_failed"
+)
+
+// applyResult is returned from Apply for every command and carried back to
+// the HTTP caller through ApplyFuture.Response().
+type applyResult struct {
+	Status    string        `json:"status"`
+	Code      string        `json:"code,omitempty"`       // machine-readable reason when Status is not "ok"
+	Error     string        `json:"error,omitempty"`      // human-readable reason when Status is not "ok"
+	Revision  uint64        `json:"revision,omitempty"`   // log index the command was applied at
+	Prev      *string       `json:"prev,omitempty"`       // value before the command, or the conflicting value when rejected
+	Value     *string       `json:"value,omitempty"`      // value after the command ("incr" and "decr")
+	Results   []txnOpResult `json:"results,omitempty"`    // per-operation outcomes ("txn")
+	Token     uint64        `json:"token,omitempty"`      // fencing token (lock operations)
+	Holder    string        `json:"holder,omitempty"`     // current lock owner, when a lock operation was rejected
+	ExpiresAt int64         `json:"expires_at,omitempty"` // lease deadline in Unix milliseconds (lock operations)
+}
+
+// result returns a successful applyResult for the entry being applied. The
+// caller must hold f.mu.
+func (f *fsm) result() *applyResult {
+	return &applyResult{Status: statusOK, Revision: f.revision}
+}
+
+// reject returns an applyResult for a committed command whose precondition
+// did not hold. The caller must hold f.mu.
+func (f *fsm) reject(code, format string, args ...interface{}) *applyResult {
+	return &applyResult{Status: statusRejected, Code: code, Error: fmt.Sprintf(format, args...), Revision: f.revision}
+}
+
+// badCommand returns an applyResult for a command that cannot be applied.
+func badCommand(code, format string, args ...interface{}) *applyResult {
+	return &applyResult{Status: statusError, Code: code, Error: fmt.Sprintf(format, args...)}
+}
+
+// withPrev records the previous value of a key, if it existed.
+func (r *applyResult) withPrev(prev string, existed bool) *applyResult {
+	if existed {
+		r.Prev = &prev
+	}
+	return r
+}
+
+// proposalError describes a command that Raft failed to commit.
+func proposalError(err error) *applyResult {
+	switch err {
+	case raft.ErrNotLeader, raft.ErrLeadershipLost, raft.ErrLeadershipTransferInProgress:
+		return badCommand(codeNotLeader, "%v", err)
+	case raft.ErrEnqueueTimeout:
+		return badCommand(codeTimeout, "%v", err)
+	default:
+		return badCommand(codeApplyFailed, "%v", err)
+	}
+}
+
+// httpStatus maps an applyResult to the HTTP status code sent to the client.
+func (r *applyResult) httpStatus() int {
+	switch r.Code {
+	case "":
+		return http.StatusOK
+	case codeBadCommand, codeUnknownOp, codeInvalidRevision:
+		return http.StatusBadRequest
+	case codePrecondition, codeLockHeld, codeNotLockHolder, codeStaleSequence:
+		return http.StatusConflict
+	case codeNotNumeric, codeOverflow:
+		return http.StatusUnprocessableEntity
+	case codeNotLeader, codeTimeout:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeResult sends r to the client as JSON.
+func writeResult(w http.ResponseWriter, r *applyResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(r.httpStatus())
+	json.NewEncoder(w).Encode(r)
+}
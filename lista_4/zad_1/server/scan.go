@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	iradix "github.com/hashicorp/go-immutable-radix"
+)
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// scanEntry is a single key/value pair returned by a scan.
+type scanEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// scanResponse is a page of scan results. NextCursor is set when more keys
+// match and can be passed back as the cursor parameter to fetch them.
+type scanResponse struct {
+	Entries    []scanEntry `json:"entries"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	readInfo
+}
+
+// scan returns, in key order, up to limit entries that start with prefix and
+// fall in [start, end). An empty end means no upper bound. more reports
+// whether further matching keys exist after the returned page.
+func (f *fsm) scan(prefix, start, end []byte, limit int) (entries []scanEntry, more bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries = []scanEntry{}
+	walkFrom(f.store.root(), prefix, start, func(k []byte, v interface{}) bool {
+		if len(end) > 0 && bytes.Compare(k, end) >= 0 {
+			return true
+		}
+		if len(entries) == limit {
+			more = true
+			return true
+		}
+		entries = append(entries, scanEntry{Key: string(k), Value: v.(string)})
+		return false
+	})
+	return entries, more
+}
+
+// walkFrom calls fn, in key order, for every key under root that starts with
+// prefix and is not less than from, until fn returns true.
+//
+// The keys not less than from are exactly the keys under from itself followed,
+// for each position i from the last byte backwards, by the keys under
+// from[:i]+c for every byte c greater than from[i]. Walking those prefixes in
+// that order seeks to the lower bound without visiting smaller keys.
+func walkFrom(root *iradix.Node, prefix, from []byte, fn iradix.WalkFn) {
+	if bytes.Compare(from, prefix) <= 0 {
+		root.WalkPrefix(prefix, fn)
+		return
+	}
+	if !bytes.HasPrefix(from, prefix) {
+		// from sorts after every key that starts with prefix.
+		return
+	}
+
+	stopped := false
+	walk := func(p []byte) {
+		root.WalkPrefix(p, func(k []byte, v interface{}) bool {
+			stopped = fn(k, v)
+			return stopped
+		})
+	}
+	walk(from)
+	for i := len(from) - 1; i >= len(prefix) && !stopped; i-- {
+		for c := int(from[i]) + 1; c <= 0xff && !stopped; c++ {
+			walk(append(from[:i:i], byte(c)))
+		}
+	}
+}
+
+// scanHandler serves ordered range scans from the leader's FSM. It accepts
+// the query parameters prefix, start (inclusive), end (exclusive), limit,
+// cursor, and consistency with node and max_staleness for stale reads.
+func scanHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := []byte(q.Get("prefix"))
+	start := []byte(q.Get("start"))
+	end := []byte(q.Get("end"))
+	opts, err := parseReadOptions(q.Get("consistency"), q.Get("node"), q.Get("max_staleness"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultScanLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > maxScanLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxScanLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	if c := q.Get("cursor"); c != "" {
+		last, err := base64.RawURLEncoding.DecodeString(c)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		// Resume at the smallest key strictly greater than the last one returned.
+		if after := append(last, 0); bytes.Compare(after, start) > 0 {
+			start = after
+		}
+	}
+
+	f, info, err := reader(opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	entries, more := f.scan(prefix, start, end, limit)
+	resp := scanResponse{Entries: entries, readInfo: info}
+	if more {
+		resp.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(entries[len(entries)-1].Key))
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,55 @@
+package main
+
+import "log"
+
+// sessionLimit bounds the deduplication table. When it is full the session
+// that has been idle for the most log entries is evicted.
+const sessionLimit = 10000
+
+// session remembers the latest write applied for a client so that retries of
+// it are answered from the cache instead of being applied again.
+type session struct {
+	Seq       uint64       `json:"seq"`
+	Result    *applyResult `json:"result"`
+	LastIndex uint64       `json:"last_index"` // log index of the client's latest write, used for eviction
+}
+
+// deduplicate returns the cached result if c repeats the latest write of its
+// client session, or a rejection if c is older than that write. It returns
+// nil if c must be applied. The caller must hold f.mu.
+func (f *fsm) deduplicate(c command) *applyResult {
+	s, ok := f.sessions.get(c.ClientID)
+	if !ok || c.Seq > s.Seq {
+		return nil
+	}
+	if c.Seq < s.Seq {
+		return f.reject(codeStaleSequence, "sequence %d of client %q was superseded by %d", c.Seq, c.ClientID, s.Seq)
+	}
+	log.Printf("[Node %s] Duplicate write %d from client %q answered from session", f.nodeID, c.Seq, c.ClientID)
+	cached := *s.Result
+	return &cached
+}
+
+// remember records res as the result of the latest write of c's client. The
+// caller must hold f.mu.
+func (f *fsm) remember(c command, res *applyResult) {
+	if _, ok := f.sessions.get(c.ClientID); !ok && f.sessions.len() >= sessionLimit {
+		f.evictIdleSession()
+	}
+	f.sessions.set(c.ClientID, &session{Seq: c.Seq, Result: res, LastIndex: f.revision})
+}
+
+// evictIdleSession drops the session whose latest write is the oldest. Ties
+// cannot occur because every write has its own log index. The caller must
+// hold f.mu.
+func (f *fsm) evictIdleSession() {
+	var oldest string
+	var oldestIndex uint64
+	f.sessions.each(func(id string, s *session) bool {
+		if oldest == "" || s.LastIndex < oldestIndex {
+			oldest, oldestIndex = id, s.LastIndex
+		}
+		return true
+	})
+	f.sessions.delete(oldest)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Snapshots are written as a fixed preamble followed by a body that may be
+// compressed:
+//
+//	preamble: magic "KVSN" | format version (1 byte) | compression (1 byte)
+//	body:     record count | applied index | compacted revision
+//	          records...
+//	          CRC-32 of the preamble and the uncompressed body
+//
+// Each record is a kind byte, a length-prefixed key and a length-prefixed
+// payload. Integers are big-endian and lengths are 32 bits. Snapshots that
+// do not start with the magic are read as the legacy single JSON object.
+//
+// Snapshots carry only replicated state. Version 1 also stored the ID of the
+// node that took it; that field is skipped when reading.
+const (
+	snapshotVersion = 2
+	maxRecordField  = 64 << 20 // bound on a single key or payload, guarding against corrupt lengths
+)
+
+var snapshotMagic = []byte("KVSN")
+
+// Compression schemes for the snapshot body.
+const (
+	compressionNone byte = 0
+	compressionGzip byte = 1
+)
+
+// Record kinds. Values are stored raw and expiry deadlines as eight bytes;
+// the other kinds hold their structure as JSON.
+const (
+	recordValue byte = iota + 1
+	recordExpiry
+	recordLock
+	recordSession
+	recordHistory
+)
+
+// snapshotData is the state carried by a snapshot. Legacy JSON snapshots
+// also hold a "nodeID" field, which is ignored.
+type snapshotData struct {
+	Store     map[string]string      `json:"store"`
+	Expires   map[string]int64       `json:"expires"`
+	Locks     map[string]*lease      `json:"locks"`
+	Sessions  map[string]*session    `json:"sessions"`
+	History   map[string]*keyHistory `json:"history"`
+	Revision  uint64                 `json:"revision"`
+	Compacted uint64                 `json:"compacted"`
+}
+
+// snapshotWriter encodes the snapshot body, hashing everything it writes. The
+// first error is kept and later writes are skipped.
+type snapshotWriter struct {
+	w   io.Writer
+	sum hash.Hash32
+	err error
+}
+
+func (sw *snapshotWriter) write(p []byte) {
+	if sw.err != nil {
+		return
+	}
+	if _, sw.err = sw.w.Write(p); sw.err == nil {
+		sw.sum.Write(p)
+	}
+}
+
+func (sw *snapshotWriter) uint64(v uint64) {
+	sw.write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (sw *snapshotWriter) field(p []byte) {
+	sw.write(binary.BigEndian.AppendUint32(nil, uint32(len(p))))
+	sw.write(p)
+}
+
+func (sw *snapshotWriter) record(kind byte, key string, payload []byte) {
+	sw.write([]byte{kind})
+	sw.field([]byte(key))
+	sw.field(payload)
+}
+
+func (sw *snapshotWriter) jsonRecord(kind byte, key string, v interface{}) {
+	if sw.err != nil {
+		return
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		sw.err = err
+		return
+	}
+	sw.record(kind, key, payload)
+}
+
+// writeSnapshot streams s to w in the current snapshot format.
+func writeSnapshot(w io.Writer, s *fsmSnapshot, compression byte) error {
+	bw := bufio.NewWriter(w)
+	sum := crc32.NewIEEE()
+	preamble := append(append([]byte(nil), snapshotMagic...), snapshotVersion, compression)
+	if _, err := bw.Write(preamble); err != nil {
+		return err
+	}
+	sum.Write(preamble)
+
+	var body io.Writer = bw
+	var gz *gzip.Writer
+	switch compression {
+	case compressionNone:
+	case compressionGzip:
+		gz = gzip.NewWriter(bw)
+		body = gz
+	default:
+		return fmt.Errorf("unknown snapshot compression %d", compression)
+	}
+
+	count := s.store.len() + s.expires.len() + s.locks.len() + s.sessions.len() + s.history.len()
+	sw := &snapshotWriter{w: body, sum: sum}
+	sw.uint64(uint64(count))
+	sw.uint64(s.revision)
+	sw.uint64(s.compacted)
+	s.store.each(func(key, value string) bool {
+		sw.record(recordValue, key, []byte(value))
+		return sw.err == nil
+	})
+	s.expires.each(func(key string, deadline int64) bool {
+		sw.record(recordExpiry, key, binary.BigEndian.AppendUint64(nil, uint64(deadline)))
+		return sw.err == nil
+	})
+	s.locks.each(func(name string, l *lease) bool {
+		sw.jsonRecord(recordLock, name, l)
+		return sw.err == nil
+	})
+	s.sessions.each(func(id string, sess *session) bool {
+		sw.jsonRecord(recordSession, id, sess)
+		return sw.err == nil
+	})
+	s.history.each(func(key string, h *keyHistory) bool {
+		sw.jsonRecord(recordHistory, key, h)
+		return sw.err == nil
+	})
+	if sw.err != nil {
+		return sw.err
+	}
+
+	// The checksum itself is not part of what it covers.
+	if _, err := body.Write(binary.BigEndian.AppendUint32(nil, sum.Sum32())); err != nil {
+		return err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// snapshotReader decodes the snapshot body, hashing everything it reads.
+type snapshotReader struct {
+	r   io.Reader
+	sum hash.Hash32
+}
+
+func (sr *snapshotReader) read(n int) ([]byte, error) {
+	p := make([]byte, n)
+	if _, err := io.ReadFull(sr.r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	sr.sum.Write(p)
+	return p, nil
+}
+
+func (sr *snapshotReader) uint64() (uint64, error) {
+	p, err := sr.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(p), nil
+}
+
+func (sr *snapshotReader) field() ([]byte, error) {
+	p, err := sr.read(4)
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(p)
+	if n > maxRecordField {
+		return nil, fmt.Errorf("snapshot field of %d bytes exceeds limit", n)
+	}
+	return sr.read(int(n))
+}
+
+// readSnapshot decodes a snapshot in either the current or the legacy JSON
+// format. Nothing is returned unless the whole snapshot was read and, for the
+// current format, its checksum matched.
+func readSnapshot(r io.Reader) (*snapshotData, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(snapshotMagic))
+	if err != nil || !bytes.Equal(magic, snapshotMagic) {
+		var data snapshotData
+		if err := json.NewDecoder(br).Decode(&data); err != nil {
+			return nil, fmt.Errorf("legacy snapshot: %w", err)
+		}
+		return &data, nil
+	}
+
+	sum := crc32.NewIEEE()
+	preamble := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(br, preamble); err != nil {
+		return nil, err
+	}
+	sum.Write(preamble)
+	formatVersion := preamble[len(snapshotMagic)]
+	if formatVersion != 1 && formatVersion != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot format version %d", formatVersion)
+	}
+
+	var body io.Reader = br
+	switch c := preamble[len(snapshotMagic)+1]; c {
+	case compressionNone:
+	case compressionGzip:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		return nil, fmt.Errorf("unknown snapshot compression %d", c)
+	}
+
+	sr := &snapshotReader{r: body, sum: sum}
+	count, err := sr.uint64()
+	if err != nil {
+		return nil, err
+	}
+	data := &snapshotData{
+		Store:    make(map[string]string),
+		Expires:  make(map[string]int64),
+		Locks:    make(map[string]*lease),
+		Sessions: make(map[string]*session),
+		History:  make(map[string]*keyHistory),
+	}
+	if data.Revision, err = sr.uint64(); err != nil {
+		return nil, err
+	}
+	if data.Compacted, err = sr.uint64(); err != nil {
+		return nil, err
+	}
+	if formatVersion == 1 {
+		if _, err := sr.field(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := uint64(0); i < count; i++ {
+		if err := readRecord(sr, data); err != nil {
+			return nil, fmt.Errorf("snapshot record %d: %w", i, err)
+		}
+	}
+
+	want := sum.Sum32()
+	trailer := make([]byte, 4)
+	if _, err := io.ReadFull(body, trailer); err != nil {
+		return nil, fmt.Errorf("snapshot checksum: %w", err)
+	}
+	if got := binary.BigEndian.Uint32(trailer); got != want {
+		return nil, fmt.Errorf("snapshot checksum mismatch: stored %08x, computed %08x", got, want)
+	}
+	return data, nil
+}
+
+// readRecord decodes one record into data.
+func readRecord(sr *snapshotReader, data *snapshotData) error {
+	kind, err := sr.read(1)
+	if err != nil {
+		return err
+	}
+	key, err := sr.field()
+	if err != nil {
+		return err
+	}
+	payload, err := sr.field()
+	if err != nil {
+		return err
+	}
+
+	switch kind[0] {
+	case recordValue:
+		data.Store[string(key)] = string(payload)
+	case recordExpiry:
+		if len(payload) != 8 {
+			return fmt.Errorf("expiry of %q has %d bytes", key, len(payload))
+		}
+		data.Expires[string(key)] = int64(binary.BigEndian.Uint64(payload))
+	case recordLock:
+		var l lease
+		if err := json.Unmarshal(payload, &l); err != nil {
+			return err
+		}
+		data.Locks[string(key)] = &l
+	case recordSession:
+		var s session
+		if err := json.Unmarshal(payload, &s); err != nil {
+			return err
+		}
+		data.Sessions[string(key)] = &s
+	case recordHistory:
+		var h keyHistory
+		if err := json.Unmarshal(payload, &h); err != nil {
+			return err
+		}
+		data.History[string(key)] = &h
+	default:
+		return fmt.Errorf("unknown record kind %d", kind[0])
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// TestRestoreKeepsNodeID installs a snapshot taken on the leader onto a
+// follower and checks that the follower keeps its own identity while taking
+// over the replicated state.
+func TestRestoreKeepsNodeID(t *testing.T) {
+	leader := newFSM("node1")
+	data, err := json.Marshal(command{Op: "set", Key: "k", Value: "v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader.Apply(&raft.Log{Index: 7, Data: data})
+
+	snap, err := leader.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := raft.NewInmemSnapshotStore()
+	sink, err := store.Create(raft.SnapshotVersionMax, 7, 1, raft.Configuration{}, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+	_, rc, err := store.Open(sink.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	follower := newFSM("node2")
+	if err := follower.Restore(rc); err != nil {
+		t.Fatal(err)
+	}
+	if follower.nodeID != "node2" {
+		t.Errorf("follower node ID = %q after restore, want %q", follower.nodeID, "node2")
+	}
+	if value, ok := follower.store.get("k"); !ok || value != "v" {
+		t.Errorf("follower value of k = %q, %v after restore, want %q, true", value, ok, "v")
+	}
+	if follower.revision != 7 {
+		t.Errorf("follower revision = %d after restore, want 7", follower.revision)
+	}
+}
+
+// TestSnapshotFormats restores snapshots in each format a node may find and
+// checks that corrupt ones are rejected.
+func TestSnapshotFormats(t *testing.T) {
+	leader := newFSM("node1")
+	for i, key := range []string{"a", "b"} {
+		data, err := json.Marshal(command{Op: "set", Key: key, Value: "value of " + key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leader.Apply(&raft.Log{Index: uint64(i + 1), Data: data})
+	}
+	snap, err := leader.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(compression byte) []byte {
+		var buf bytes.Buffer
+		if err := writeSnapshot(&buf, snap.(*fsmSnapshot), compression); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	flip := func(body []byte) []byte {
+		flipped := append([]byte(nil), body...)
+		flipped[len(flipped)/2] ^= 0xff
+		return flipped
+	}
+
+	for _, tc := range []struct {
+		name         string
+		body         []byte
+		wantErr      bool
+		wantRevision uint64
+	}{
+		{name: "uncompressed", body: encode(compressionNone), wantRevision: 2},
+		{name: "gzip", body: encode(compressionGzip), wantRevision: 2},
+		{name: "flipped byte uncompressed", body: flip(encode(compressionNone)), wantErr: true},
+		{name: "flipped byte gzip", body: flip(encode(compressionGzip)), wantErr: true},
+		{name: "legacy JSON", body: []byte(`{"store":{"a":"value of a","b":"value of b"},"nodeID":"node1"}`)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			follower := newFSM("node2")
+			err := follower.Restore(io.NopCloser(bytes.NewReader(tc.body)))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Restore accepted a corrupt snapshot")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Restore: %v", err)
+			}
+			if follower.nodeID != "node2" {
+				t.Errorf("node ID = %q after restore, want %q", follower.nodeID, "node2")
+			}
+			for _, key := range []string{"a", "b"} {
+				if value, ok := follower.store.get(key); !ok || value != "value of "+key {
+					t.Errorf("value of %s = %q, %v after restore, want %q, true", key, value, ok, "value of "+key)
+				}
+			}
+			if follower.revision != tc.wantRevision {
+				t.Errorf("revision = %d after restore, want %d", follower.revision, tc.wantRevision)
+			}
+		})
+	}
+}
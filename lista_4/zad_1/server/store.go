@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// segmentSize is the size at which the log store starts a new segment file.
+const segmentSize = 4 << 20
+
+// fileLogStore is a raft.LogStore keeping the log in append-only segment
+// files named after the index of their first entry. Each entry is a record
+// of a 4-byte length, a 4-byte CRC-32 of the payload and the JSON-encoded
+// raft.Log. Appends are fsynced before StoreLogs returns.
+//
+// Deleting a prefix records the new first index in a meta file before
+// removing segments that fell below it. Deleting a suffix removes the newest
+// segments first and then truncates, so a crash at any point leaves a
+// contiguous log. A torn record at the end of the log, left by a crash
+// during an append, is cut off when the store is opened.
+type fileLogStore struct {
+	mu       sync.RWMutex
+	dir      string
+	segments []*segment // oldest first; only the last one is appended to
+	first    uint64     // entries below this index have been deleted
+}
+
+// segment is one file of the log.
+type segment struct {
+	file    *os.File
+	first   uint64  // index of the first entry in the file
+	offsets []int64 // offset of each entry, the i-th having index first+i
+	size    int64
+}
+
+func (s *segment) last() uint64 {
+	return s.first + uint64(len(s.offsets)) - 1
+}
+
+// logMeta is the content of the log store's meta file.
+type logMeta struct {
+	First uint64 `json:"first"`
+}
+
+// newFileLogStore opens or creates the log kept in dir.
+func newFileLogStore(dir string) (*fileLogStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &fileLogStore{dir: dir}
+
+	var meta logMeta
+	switch data, err := os.ReadFile(s.metaPath()); {
+	case err == nil:
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("log meta: %w", err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names) // zero-padded first indexes sort numerically
+	for i, name := range names {
+		seg, err := openSegment(name)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		torn := seg.truncateTorn()
+		if len(seg.offsets) == 0 || seg.last() < meta.First {
+			// Created just before a crash, or left behind by a prefix
+			// deletion that did not finish.
+			if err := removeSegment(seg); err != nil {
+				s.Close()
+				return nil, err
+			}
+			continue
+		}
+		if len(s.segments) > 0 && seg.first != s.lastIndex()+1 {
+			seg.file.Close()
+			s.Close()
+			return nil, fmt.Errorf("segment %s does not follow the previous one", filepath.Base(name))
+		}
+		s.segments = append(s.segments, seg)
+		if !torn {
+			continue
+		}
+		// Only the newest segment is ever appended to, so anything after a
+		// torn record cannot be trusted.
+		for _, later := range names[i+1:] {
+			log.Printf("log store %s: removing %s after torn record", dir, filepath.Base(later))
+			if err := os.Remove(later); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		break
+	}
+	if len(s.segments) > 0 {
+		s.first = max(meta.First, s.segments[0].first)
+	}
+	return s, nil
+}
+
+// openSegment opens the segment file at path and indexes its records,
+// stopping at the first incomplete or corrupt one. A zero length counts as
+// corrupt: no encoded raft.Log is empty, and the zeros a crash can leave at
+// the end of a file would otherwise pass as records with a matching CRC.
+func openSegment(path string) (*segment, error) {
+	first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ".log"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected segment file name %s", filepath.Base(path))
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	seg := &segment{file: file, first: first}
+	header := make([]byte, 8)
+	for {
+		if _, err := file.ReadAt(header, seg.size); err != nil {
+			break
+		}
+		n := int64(binary.BigEndian.Uint32(header))
+		if n == 0 || n > info.Size()-seg.size-8 {
+			break
+		}
+		payload := make([]byte, n)
+		if _, err := file.ReadAt(payload, seg.size+8); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			break
+		}
+		seg.offsets = append(seg.offsets, seg.size)
+		seg.size += 8 + int64(len(payload))
+	}
+	return seg, nil
+}
+
+// truncateTorn cuts off anything after the last valid record and reports
+// whether there was something to cut.
+func (s *segment) truncateTorn() bool {
+	info, err := s.file.Stat()
+	if err != nil || info.Size() == s.size {
+		return false
+	}
+	log.Printf("log store: truncating torn record at offset %d of %s", s.size, s.file.Name())
+	if err := s.file.Truncate(s.size); err == nil {
+		s.file.Sync()
+	}
+	return true
+}
+
+func removeSegment(seg *segment) error {
+	seg.file.Close()
+	return os.Remove(seg.file.Name())
+}
+
+func (s *fileLogStore) metaPath() string {
+	return filepath.Join(s.dir, "meta.json")
+}
+
+func (s *fileLogStore) lastIndex() uint64 {
+	if len(s.segments) == 0 {
+		return 0
+	}
+	return s.segments[len(s.segments)-1].last()
+}
+
+// FirstIndex returns the first index written, or 0 for an empty log.
+func (s *fileLogStore) FirstIndex() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.first, nil
+}
+
+// LastIndex returns the last index written, or 0 for an empty log.
+func (s *fileLogStore) LastIndex() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastIndex(), nil
+}
+
+// GetLog reads the entry at index into out.
+func (s *fileLogStore) GetLog(index uint64, out *raft.Log) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.segments) == 0 || index < s.first || index > s.lastIndex() {
+		return raft.ErrLogNotFound
+	}
+	i := sort.Search(len(s.segments), func(i int) bool { return s.segments[i].last() >= index })
+	seg := s.segments[i]
+
+	offset := seg.offsets[index-seg.first]
+	header := make([]byte, 8)
+	if _, err := seg.file.ReadAt(header, offset); err != nil {
+		return err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := seg.file.ReadAt(payload, offset+8); err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, out)
+}
+
+// StoreLog appends a single entry.
+func (s *fileLogStore) StoreLog(l *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{l})
+}
+
+// StoreLogs appends entries, which must continue the log, and syncs them to
+// disk. On failure, entries that were not written are forgotten again.
+func (s *fileLogStore) StoreLogs(logs []*raft.Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(logs); err != nil {
+		s.discardUnwritten()
+		return err
+	}
+	return nil
+}
+
+// append indexes and writes logs. The caller must hold s.mu.
+func (s *fileLogStore) append(logs []*raft.Log) error {
+	var pending []byte
+	for _, l := range logs {
+		if len(s.segments) > 0 && l.Index != s.lastIndex()+1 {
+			return fmt.Errorf("log entry %d does not follow last index %d", l.Index, s.lastIndex())
+		}
+		if len(s.segments) == 0 || s.segments[len(s.segments)-1].size+int64(len(pending)) >= segmentSize {
+			if err := s.flush(pending); err != nil {
+				return err
+			}
+			pending = nil
+			if err := s.startSegment(l.Index); err != nil {
+				return err
+			}
+		}
+
+		payload, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		seg := s.segments[len(s.segments)-1]
+		seg.offsets = append(seg.offsets, seg.size+int64(len(pending)))
+		pending = binary.BigEndian.AppendUint32(pending, uint32(len(payload)))
+		pending = binary.BigEndian.AppendUint32(pending, crc32.ChecksumIEEE(payload))
+		pending = append(pending, payload...)
+	}
+	return s.flush(pending)
+}
+
+// flush writes records to the end of the last segment and syncs it. The
+// caller must hold s.mu and have already recorded the records' offsets.
+func (s *fileLogStore) flush(records []byte) error {
+	if len(records) == 0 {
+		return nil
+	}
+	seg := s.segments[len(s.segments)-1]
+	if _, err := seg.file.WriteAt(records, seg.size); err != nil {
+		return err
+	}
+	if err := seg.file.Sync(); err != nil {
+		return err
+	}
+	seg.size += int64(len(records))
+	return nil
+}
+
+// discardUnwritten drops the offsets of records that never reached the
+// segment files, and segments left with no records. The caller must hold
+// s.mu.
+func (s *fileLogStore) discardUnwritten() {
+	for len(s.segments) > 0 {
+		seg := s.segments[len(s.segments)-1]
+		n := sort.Search(len(seg.offsets), func(i int) bool { return seg.offsets[i] >= seg.size })
+		seg.offsets = seg.offsets[:n]
+		if n > 0 {
+			return
+		}
+		if err := removeSegment(seg); err != nil {
+			log.Printf("log store %s: removing empty segment: %v", s.dir, err)
+		}
+		s.segments = s.segments[:len(s.segments)-1]
+	}
+	s.first = 0
+}
+
+// startSegment creates an empty segment whose first entry will be index. The
+// caller must hold s.mu.
+func (s *fileLogStore) startSegment(index uint64) error {
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d.log", index))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		file.Close()
+		return err
+	}
+	if len(s.segments) == 0 {
+		s.first = index
+	}
+	s.segments = append(s.segments, &segment{file: file, first: index})
+	return nil
+}
+
+// DeleteRange deletes the entries from min to max inclusive. Raft only ever
+// deletes a prefix or a suffix of the log.
+func (s *fileLogStore) DeleteRange(min, max uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := s.lastIndex()
+	switch {
+	case len(s.segments) == 0 || max < s.first || min > last:
+		return nil
+	case min <= s.first && max >= last:
+		return s.deleteAll()
+	case min <= s.first:
+		return s.deletePrefix(max + 1)
+	case max >= last:
+		return s.deleteSuffix(min)
+	}
+	return fmt.Errorf("cannot delete entries %d to %d from the middle of the log", min, max)
+}
+
+// deleteAll removes every segment. The caller must hold s.mu.
+func (s *fileLogStore) deleteAll() error {
+	if err := s.writeMeta(logMeta{}); err != nil {
+		return err
+	}
+	for len(s.segments) > 0 {
+		if err := removeSegment(s.segments[len(s.segments)-1]); err != nil {
+			return err
+		}
+		s.segments = s.segments[:len(s.segments)-1]
+	}
+	s.first = 0
+	return syncDir(s.dir)
+}
+
+// deletePrefix makes first the first index and removes the segments that lie
+// entirely below it. The caller must hold s.mu.
+func (s *fileLogStore) deletePrefix(first uint64) error {
+	if err := s.writeMeta(logMeta{First: first}); err != nil {
+		return err
+	}
+	s.first = first
+	for len(s.segments) > 0 && s.segments[0].last() < first {
+		if err := removeSegment(s.segments[0]); err != nil {
+			return err
+		}
+		s.segments = s.segments[1:]
+	}
+	return syncDir(s.dir)
+}
+
+// deleteSuffix removes every entry from min on, newest first. The caller must
+// hold s.mu.
+func (s *fileLogStore) deleteSuffix(min uint64) error {
+	for {
+		seg := s.segments[len(s.segments)-1]
+		if seg.first < min {
+			n := min - seg.first
+			if err := seg.file.Truncate(seg.offsets[n]); err != nil {
+				return err
+			}
+			if err := seg.file.Sync(); err != nil {
+				return err
+			}
+			seg.size = seg.offsets[n]
+			seg.offsets = seg.offsets[:n]
+			return syncDir(s.dir)
+		}
+		if err := removeSegment(seg); err != nil {
+			return err
+		}
+		s.segments = s.segments[:len(s.segments)-1]
+	}
+}
+
+// writeMeta replaces the meta file. The caller must hold s.mu.
+func (s *fileLogStore) writeMeta(meta logMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.metaPath(), data)
+}
+
+// Close closes the segment files.
+func (s *fileLogStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, seg := range s.segments {
+		err = errors.Join(err, seg.file.Close())
+	}
+	s.segments = nil
+	return err
+}
+
+// fileStableStore is a raft.StableStore keeping its few keys (current term,
+// last vote) in one JSON file that is replaced atomically on every write.
+type fileStableStore struct {
+	mu     sync.Mutex
+	path   string
+	values map[string][]byte
+}
+
+// newFileStableStore opens or creates the stable store kept in path.
+func newFileStableStore(path string) (*fileStableStore, error) {
+	s := &fileStableStore{path: path, values: make(map[string][]byte)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.values); err != nil {
+		return nil, fmt.Errorf("stable store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Set stores val under key.
+func (s *fileStableStore) Set(key, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, existed := s.values[string(key)]
+	s.values[string(key)] = append([]byte(nil), val...)
+	data, err := json.Marshal(s.values)
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		// Keep memory in line with what is on disk.
+		if existed {
+			s.values[string(key)] = prev
+		} else {
+			delete(s.values, string(key))
+		}
+	}
+	return err
+}
+
+// Get returns the value of key. Like raft's own stores, it reports a missing
+// key with a "not found" error.
+func (s *fileStableStore) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.values[string(key)]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return append([]byte(nil), val...), nil
+}
+
+// SetUint64 stores val under key.
+func (s *fileStableStore) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, binary.BigEndian.AppendUint64(nil, val))
+}
+
+// GetUint64 returns the value of key, or zero if it is missing.
+func (s *fileStableStore) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err != nil {
+		return 0, nil
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("value of %q is not a uint64", key)
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+// writeFileAtomic replaces the file at path with data, so that after a crash
+// it holds either the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes directory entries, making created, renamed and removed
+// files durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
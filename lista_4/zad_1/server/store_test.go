@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// entrySize makes a few hundred entries span several segments.
+const entrySize = 64 << 10
+
+func entryData(index uint64) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("%08d", index)), entrySize/8)
+}
+
+func storeEntries(t *testing.T, s *fileLogStore, from, to uint64) {
+	t.Helper()
+	var logs []*raft.Log
+	for i := from; i <= to; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: 1, Type: raft.LogCommand, Data: entryData(i)})
+	}
+	if err := s.StoreLogs(logs); err != nil {
+		t.Fatalf("StoreLogs(%d..%d): %v", from, to, err)
+	}
+}
+
+// checkLog checks that s holds exactly the entries first to last, or nothing
+// if both are 0.
+func checkLog(t *testing.T, s *fileLogStore, first, last uint64) {
+	t.Helper()
+	if got, _ := s.FirstIndex(); got != first {
+		t.Errorf("FirstIndex = %d, want %d", got, first)
+	}
+	if got, _ := s.LastIndex(); got != last {
+		t.Errorf("LastIndex = %d, want %d", got, last)
+	}
+	var l raft.Log
+	for i := first; i <= last && last > 0; i++ {
+		if err := s.GetLog(i, &l); err != nil {
+			t.Fatalf("GetLog(%d): %v", i, err)
+		}
+		if l.Index != i || !bytes.Equal(l.Data, entryData(i)) {
+			t.Fatalf("GetLog(%d) returned entry %d with unexpected data", i, l.Index)
+		}
+	}
+	for _, i := range []uint64{first - 1, last + 1} {
+		if i == 0 {
+			continue
+		}
+		if err := s.GetLog(i, &l); err != raft.ErrLogNotFound {
+			t.Errorf("GetLog(%d) = %v, want %v", i, err, raft.ErrLogNotFound)
+		}
+	}
+}
+
+func reopen(t *testing.T, s *fileLogStore) *fileLogStore {
+	t.Helper()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newFileLogStore(s.dir)
+	if err != nil {
+		t.Fatalf("reopening log store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// TestFileLogStore writes entries across several segments, deletes a prefix,
+// a suffix and then everything, and checks that each state survives
+// reopening the store.
+func TestFileLogStore(t *testing.T) {
+	s, err := newFileLogStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	storeEntries(t, s, 1, 100)
+	storeEntries(t, s, 101, 200)
+	if len(s.segments) < 3 {
+		t.Fatalf("200 entries of %d bytes fill %d segments, want at least 3", entrySize, len(s.segments))
+	}
+	s = reopen(t, s)
+	checkLog(t, s, 1, 200)
+
+	// The prefix ends past the first segment, so that segment goes.
+	prefixEnd := s.segments[1].first + 5
+	if err := s.DeleteRange(1, prefixEnd); err != nil {
+		t.Fatal(err)
+	}
+	checkLog(t, s, prefixEnd+1, 200)
+	s = reopen(t, s)
+	checkLog(t, s, prefixEnd+1, 200)
+
+	// The suffix starts before the last segment, so that segment goes.
+	suffixStart := s.segments[len(s.segments)-1].first - 5
+	if err := s.DeleteRange(suffixStart, 200); err != nil {
+		t.Fatal(err)
+	}
+	checkLog(t, s, prefixEnd+1, suffixStart-1)
+	s = reopen(t, s)
+	checkLog(t, s, prefixEnd+1, suffixStart-1)
+
+	// The log continues where the suffix was cut off.
+	storeEntries(t, s, suffixStart, 210)
+	s = reopen(t, s)
+	checkLog(t, s, prefixEnd+1, 210)
+
+	if err := s.DeleteRange(0, 210); err != nil {
+		t.Fatal(err)
+	}
+	checkLog(t, s, 0, 0)
+	s = reopen(t, s)
+	checkLog(t, s, 0, 0)
+
+	// An empty log takes any starting index, as after installing a snapshot.
+	storeEntries(t, s, 500, 505)
+	s = reopen(t, s)
+	checkLog(t, s, 500, 505)
+}
+
+// TestFileLogStoreTornTail checks that a record cut short by a crash is
+// dropped on open and that appending carries on after the last whole entry.
+func TestFileLogStoreTornTail(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		tail []byte
+	}{
+		// Header of a 1000-byte record followed by only part of its payload.
+		{"partial record", append([]byte{0, 0, 3, 232, 1, 2, 3, 4}, make([]byte, 100)...)},
+		// Space the file system allocated before the crash but never wrote.
+		{"zero fill", make([]byte, 4096)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := newFileLogStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			storeEntries(t, s, 1, 80)
+
+			last := s.segments[len(s.segments)-1]
+			whole := last.size
+			if _, err := last.file.WriteAt(tc.tail, whole); err != nil {
+				t.Fatal(err)
+			}
+
+			// A well-formed segment that continues the log but was started
+			// after the torn record cannot be trusted either.
+			other, err := newFileLogStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			storeEntries(t, other, 81, 81)
+			data, err := os.ReadFile(other.segments[0].file.Name())
+			other.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			later := filepath.Join(s.dir, fmt.Sprintf("%020d.log", 81))
+			if err := os.WriteFile(later, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s = reopen(t, s)
+			checkLog(t, s, 1, 80)
+			if info, err := os.Stat(last.file.Name()); err != nil {
+				t.Error(err)
+			} else if info.Size() != whole {
+				t.Errorf("segment with the torn record is %d bytes, want it truncated to %d", info.Size(), whole)
+			}
+			if _, err := os.Stat(later); !os.IsNotExist(err) {
+				t.Errorf("segment after the torn record was kept: %v", err)
+			}
+
+			storeEntries(t, s, 81, 90)
+			s = reopen(t, s)
+			checkLog(t, s, 1, 90)
+		})
+	}
+}
+
+// TestFileLogStoreDiscardUnwritten checks that entries rejected by StoreLogs
+// leave the log as it was.
+func TestFileLogStoreDiscardUnwritten(t *testing.T) {
+	s, err := newFileLogStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	storeEntries(t, s, 1, 10)
+
+	// The batch breaks off at a gap, after its first entry was indexed.
+	err = s.StoreLogs([]*raft.Log{{Index: 11, Data: entryData(11)}, {Index: 13, Data: entryData(13)}})
+	if err == nil {
+		t.Fatal("StoreLogs accepted a batch with a gap")
+	}
+	checkLog(t, s, 1, 10)
+	storeEntries(t, s, 11, 12)
+	s = reopen(t, s)
+	checkLog(t, s, 1, 12)
+}
+
+// TestFileStableStore checks that values and counters survive reopening.
+func TestFileStableStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stable.json")
+	s, err := newFileStableStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set([]byte("LastVoteCand"), []byte("node2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetUint64([]byte("CurrentTerm"), 42); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = newFileStableStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get([]byte("LastVoteCand")); err != nil || string(v) != "node2" {
+		t.Errorf("Get(LastVoteCand) = %q, %v, want %q", v, err, "node2")
+	}
+	if v, err := s.GetUint64([]byte("CurrentTerm")); err != nil || v != 42 {
+		t.Errorf("GetUint64(CurrentTerm) = %d, %v, want 42", v, err)
+	}
+	if _, err := s.Get([]byte("missing")); err == nil {
+		t.Error("Get of a missing key succeeded")
+	}
+	if v, err := s.GetUint64([]byte("missing")); err != nil || v != 0 {
+		t.Errorf("GetUint64 of a missing key = %d, %v, want 0, nil", v, err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import iradix "github.com/hashicorp/go-immutable-radix"
+
+// treeMap is a persistent map from string keys to values of type V, kept in
+// key order in an immutable radix tree. Every update replaces the tree, so a
+// copy of a treeMap is an O(1) point-in-time view that later writes never
+// change. Values are shared between views and must not be mutated once
+// stored; replace them instead. The zero value is an empty map.
+type treeMap[V any] struct {
+	tree *iradix.Tree
+}
+
+// treeMapOf builds a treeMap holding the entries of m.
+func treeMapOf[V any](m map[string]V) treeMap[V] {
+	txn := iradix.New().Txn()
+	for key, v := range m {
+		txn.Insert([]byte(key), v)
+	}
+	return treeMap[V]{tree: txn.Commit()}
+}
+
+func (m treeMap[V]) get(key string) (V, bool) {
+	var v V
+	if m.tree == nil {
+		return v, false
+	}
+	raw, ok := m.tree.Get([]byte(key))
+	if ok {
+		v = raw.(V)
+	}
+	return v, ok
+}
+
+func (m *treeMap[V]) set(key string, v V) {
+	if m.tree == nil {
+		m.tree = iradix.New()
+	}
+	m.tree, _, _ = m.tree.Insert([]byte(key), v)
+}
+
+func (m *treeMap[V]) delete(key string) {
+	if m.tree == nil {
+		return
+	}
+	m.tree, _, _ = m.tree.Delete([]byte(key))
+}
+
+func (m treeMap[V]) len() int {
+	if m.tree == nil {
+		return 0
+	}
+	return m.tree.Len()
+}
+
+// root returns the root of the underlying tree for ordered walks.
+func (m treeMap[V]) root() *iradix.Node {
+	if m.tree == nil {
+		return iradix.New().Root()
+	}
+	return m.tree.Root()
+}
+
+// each calls fn for every entry in key order until fn returns false. The map
+// may be updated from fn; the walk still sees the entries as they were when
+// it started.
+func (m treeMap[V]) each(fn func(key string, v V) bool) {
+	m.root().Walk(func(k []byte, raw interface{}) bool {
+		return !fn(string(k), raw.(V))
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	eventBufferSize = 1024 // recent events kept per node so watches can resume
+	watchBufferSize = 256  // events queued per watcher before it is dropped as too slow
+)
+
+// errEventsTrimmed is returned when a watch asks to resume from an index that
+// is no longer in the node's event buffer.
+var errEventsTrimmed = errors.New("requested index is no longer available, restart the watch without an index")
+
+// event describes a committed change to a key.
+type event struct {
+	Type  string `json:"type"` // "set" or "delete"
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Index uint64 `json:"index"` // log index of the change
+}
+
+// watcher receives the events for a single key, or for every key under a
+// prefix.
+type watcher struct {
+	key    string
+	prefix bool
+	ch     chan event
+}
+
+func (w *watcher) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+// notify records e in the event buffer and delivers it to every matching
+// watcher. A watcher whose queue is full is closed rather than allowed to
+// block Apply. The caller must hold f.mu.
+func (f *fsm) notify(e event) {
+	f.events = append(f.events, e)
+	if len(f.events) > eventBufferSize {
+		f.eventsFloor = f.events[0].Index + 1
+		f.events = append([]event(nil), f.events[len(f.events)-eventBufferSize:]...)
+	}
+
+	for w := range f.watchers {
+		if !w.matches(e.Key) {
+			continue
+		}
+		select {
+		case w.ch <- e:
+		default:
+			close(w.ch)
+			delete(f.watchers, w)
+		}
+	}
+}
+
+// watch registers a watcher for key and returns the buffered events with an
+// index of at least from that it would have missed. A zero from only streams
+// new events.
+func (f *fsm) watch(key string, prefix bool, from uint64) (*watcher, []event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w := &watcher{key: key, prefix: prefix, ch: make(chan event, watchBufferSize)}
+	var backlog []event
+	if from > 0 {
+		if from < f.eventsFloor {
+			return nil, nil, errEventsTrimmed
+		}
+		for _, e := range f.events {
+			if e.Index >= from && w.matches(e.Key) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+	f.watchers[w] = struct{}{}
+	return w, backlog, nil
+}
+
+// unwatch removes w, closing its channel if it is still registered.
+func (f *fsm) unwatch(w *watcher) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.watchers[w]; ok {
+		close(w.ch)
+		delete(f.watchers, w)
+	}
+}
+
+// closeWatchers ends every watch on this FSM, e.g. when its node stops or
+// its state is replaced by a snapshot. The caller must hold f.mu.
+func (f *fsm) closeWatchers() {
+	for w := range f.watchers {
+		close(w.ch)
+		delete(f.watchers, w)
+	}
+}
+
+// watchHandler streams changes as newline-delimited JSON events. It accepts
+// the query parameters key, prefix (true to watch every key under key) and
+// from (log index to resume from).
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	key := q.Get("key")
+	prefix := q.Get("prefix") == "true"
+	if key == "" && !prefix {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	var from uint64
+	if s := q.Get("from"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid from index", http.StatusBadRequest)
+			return
+		}
+		from = n
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	leader := getLeader()
+	if leader == nil {
+		http.Error(w, "no leader elected", http.StatusServiceUnavailable)
+		return
+	}
+	leaderFSM := fsmFor(leader)
+	if leaderFSM == nil {
+		http.Error(w, "leader FSM not found", http.StatusInternalServerError)
+		return
+	}
+
+	watch, backlog, err := leaderFSM.watch(key, prefix, from)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	defer leaderFSM.unwatch(watch)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	for _, e := range backlog {
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-watch.ch:
+			if !ok {
+				// The watcher fell behind or its node stopped; the client
+				// can resume from the last index it saw.
+				return
+			}
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}